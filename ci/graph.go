@@ -0,0 +1,225 @@
+package ci
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Statuses of the nodes after the Graph has been run
+const (
+	NodeSucceeded = "SUCCEEDED"
+	NodeFailed    = "FAILED"
+	// NodeSkipped is not run, because a node it depends on has failed
+	NodeSkipped = "SKIPPED"
+	// NodeStopped is not run, because the graph has failed fast
+	NodeStopped = "STOPPED"
+)
+
+// Node is a unit of work of the Graph, which is run once all nodes it depends
+// on are done.
+type Node struct {
+	ID        string
+	DependsOn []string
+
+	// IgnoreFailure lets nodes which depend on this one run, even if this
+	// one fails
+	IgnoreFailure bool
+}
+
+// Graph schedules nodes according to their dependencies, running independent
+// nodes concurrently.
+type Graph struct {
+	nodes []Node
+	index map[string]int
+}
+
+// NewGraph creates a Graph, once it is checked that IDs of the nodes are
+// unique, dependencies are known and there are no cycles.
+func NewGraph(nodes []Node) (*Graph, error) {
+	g := &Graph{nodes: nodes, index: map[string]int{}}
+	for i, n := range nodes {
+		if _, ok := g.index[n.ID]; ok {
+			return nil, fmt.Errorf("%s is defined more than once", n.ID)
+		}
+		g.index[n.ID] = i
+	}
+
+	for _, n := range nodes {
+		for _, dep := range n.DependsOn {
+			if _, ok := g.index[dep]; !ok {
+				return nil, fmt.Errorf("%s depends on unknown %s", n.ID, dep)
+			}
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	return g, nil
+}
+
+// findCycle returns IDs of the nodes which form a cycle (the first one is
+// repeated at the end) or nil when there is none.
+func (g *Graph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(g.nodes))
+	path := []string{}
+
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		state[i] = visiting
+		path = append(path, g.nodes[i].ID)
+		for _, dep := range g.nodes[i].DependsOn {
+			j := g.index[dep]
+			switch state[j] {
+			case visiting:
+				for k, id := range path {
+					if id == dep {
+						return append(append([]string{}, path[k:]...), dep)
+					}
+				}
+			case unvisited:
+				if cycle := visit(j); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range g.nodes {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// Order returns IDs of the nodes in the order they can be run one after
+// another; independent nodes keep the order in which they were defined.
+func (g *Graph) Order() []string {
+	order := []string{}
+	done := map[string]bool{}
+	for len(order) < len(g.nodes) {
+		for _, n := range g.nodes {
+			if done[n.ID] || !g.dependenciesIn(n, done) {
+				continue
+			}
+			done[n.ID] = true
+			order = append(order, n.ID)
+			break
+		}
+	}
+	return order
+}
+
+func (g *Graph) dependenciesIn(n Node, done map[string]bool) bool {
+	for _, dep := range n.DependsOn {
+		if !done[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+type nodeResult struct {
+	id  string
+	err error
+}
+
+// Run runs nodes, at most concurrency of them at the same time (less than 1 -
+// as many as CPUs), each once all nodes it depends on have succeeded (or have
+// failed with IgnoreFailure). Nodes which depend on a failed node are
+// skipped. With fastFail nodes which have not started yet are stopped after
+// the first failure, which is not ignored. Statuses are returned by IDs of
+// the nodes.
+func (g *Graph) Run(concurrency int, fastFail bool, run func(id string) error) map[string]string {
+	if concurrency < 1 {
+		concurrency = runtime.NumCPU()
+	}
+
+	statuses := map[string]string{}
+	pending := map[string]int{}
+	dependents := map[string][]string{}
+	ready := []string{}
+	for _, n := range g.nodes {
+		pending[n.ID] = len(n.DependsOn)
+		for _, dep := range n.DependsOn {
+			dependents[dep] = append(dependents[dep], n.ID)
+		}
+		if len(n.DependsOn) == 0 {
+			ready = append(ready, n.ID)
+		}
+	}
+
+	var skip func(id string)
+	skip = func(id string) {
+		for _, d := range dependents[id] {
+			if _, ok := statuses[d]; !ok {
+				statuses[d] = NodeSkipped
+				skip(d)
+			}
+		}
+	}
+
+	results := make(chan nodeResult)
+	running, failed := 0, false
+	for {
+		for running < concurrency && len(ready) > 0 {
+			id := ready[0]
+			ready = ready[1:]
+			if fastFail && failed {
+				statuses[id] = NodeStopped
+				continue
+			}
+
+			running++
+			go func(id string) {
+				results <- nodeResult{id, run(id)}
+			}(id)
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+
+		n := g.nodes[g.index[r.id]]
+		if r.err != nil {
+			statuses[r.id] = NodeFailed
+			if !n.IgnoreFailure {
+				failed = true
+				skip(r.id)
+				continue
+			}
+		} else {
+			statuses[r.id] = NodeSucceeded
+		}
+
+		for _, d := range dependents[r.id] {
+			pending[d]--
+			if _, done := statuses[d]; !done && pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+
+	// Nodes which were waiting for stopped ones have never become ready
+	for _, n := range g.nodes {
+		if _, ok := statuses[n.ID]; !ok {
+			statuses[n.ID] = NodeStopped
+		}
+	}
+	return statuses
+}
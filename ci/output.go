@@ -0,0 +1,69 @@
+package ci
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// SharedOutput lets many concurrently running containers write their logs to
+// a single writer, without mixing up their lines.
+type SharedOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewSharedOutput creates SharedOutput which writes to w
+func NewSharedOutput(w io.Writer) *SharedOutput {
+	return &SharedOutput{w: w}
+}
+
+// Prefixed returns a writer which puts the prefix in front of every line.
+// Incomplete lines are kept until they end or the writer is closed.
+func (o *SharedOutput) Prefixed(prefix string) io.WriteCloser {
+	return &prefixWriter{output: o, prefix: []byte(prefix)}
+}
+
+type prefixWriter struct {
+	output *SharedOutput
+	prefix []byte
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+
+	end := bytes.LastIndexByte(pw.buf, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+
+	err := pw.flush(pw.buf[:end+1])
+	pw.buf = append([]byte{}, pw.buf[end+1:]...)
+	return len(p), err
+}
+
+// Close writes the remaining incomplete line
+func (pw *prefixWriter) Close() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+
+	err := pw.flush(append(pw.buf, '\n'))
+	pw.buf = nil
+	return err
+}
+
+func (pw *prefixWriter) flush(lines []byte) error {
+	out := []byte{}
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			out = append(append(out, pw.prefix...), line...)
+		}
+	}
+
+	pw.output.mu.Lock()
+	defer pw.output.mu.Unlock()
+	_, err := pw.output.w.Write(out)
+	return err
+}
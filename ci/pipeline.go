@@ -35,15 +35,40 @@ func (p *Pipeline) AddStage(stage *Stage) {
 	p.Stages = append(p.Stages, stage)
 }
 
+// Stage groups commands which are run one after another. Finally commands are
+// guaranteed to run after Commands, regardless of whether any of them failed.
 type Stage struct {
 	Name     string
 	Commands []Command
+	Finally  []Command
+
+	// OnFailure decides what happens with the remaining stages when this
+	// stage fails.
+	OnFailure FailureAction
+	// Fallback is a name of the stage which is still run when this stage
+	// fails and aborts the pipeline (empty - nothing else is run).
+	Fallback string
+
+	// User runs commands of the stage (empty - the default user of the
+	// container)
+	User string
 }
 
-func NewStage(name string, cmds []Command) *Stage {
+// FailureAction defines how the pipeline proceeds after a failed stage.
+type FailureAction int
+
+const (
+	// Abort skips all remaining stages, except the Fallback of the failed one
+	Abort FailureAction = iota
+	// Continue moves on to the next stage as if nothing has failed
+	Continue
+)
+
+func NewStage(name string, cmds []Command, finally []Command) *Stage {
 	return &Stage{
 		Name:     name,
 		Commands: cmds,
+		Finally:  finally,
 	}
 }
 
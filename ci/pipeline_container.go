@@ -1,16 +1,22 @@
 package ci
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 )
 
@@ -21,6 +27,33 @@ func (p *Pipeline) ContainerCreate(name string, config *container.Config, host *
 	return cont, err
 }
 
+// ImageHasExecutable checks, using a short-living container, whether the
+// executable (a name looked up in PATH or an absolute path) exists in the image.
+func (p *Pipeline) ImageHasExecutable(image, executable string) (bool, error) {
+	config := &container.Config{
+		Image:      image,
+		Entrypoint: []string{"sh", "-c", `command -v "$0" >/dev/null`},
+		Cmd:        []string{executable},
+	}
+
+	cont, err := p.ContainerCreate("", config, &container.HostConfig{})
+	if err != nil {
+		return false, err
+	}
+	defer p.CleanUp(cont.ID)
+
+	if err := p.ContainerStart(cont.ID); err != nil {
+		return false, err
+	}
+
+	exitCode, err := p.ContainerWait(cont.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return exitCode == 0, nil
+}
+
 // NetworkConnect connects container with a specified network
 func (p *Pipeline) NetworkConnect(contID, netName string) error {
 	err := p.Client.NetworkConnect(p.Context, netName, contID, nil)
@@ -57,6 +90,63 @@ func (p *Pipeline) ContainerAttach(contID string) (io.ReadCloser, io.ReadCloser,
 	return stdout, stderr, nil
 }
 
+// CopyFromContainer reads contents of a single file located in the container.
+// It works also for containers which are already stopped.
+func (p *Pipeline) CopyFromContainer(contID, path string) ([]byte, error) {
+	content, _, err := p.Client.CopyFromContainer(p.Context, contID, path)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	// Docker always sends a tar archive, even for a single file
+	archive := tar.NewReader(content)
+	if _, err := archive.Next(); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(archive)
+}
+
+// IsNotFound tells whether the error is caused by a missing file or container
+func IsNotFound(err error) bool {
+	return client.IsErrNotFound(err)
+}
+
+// CopyToContainer writes files (paths relative to the dir, which has to exist
+// in the container) with the given mode. Missing parent directories are
+// created. It works also for containers which have not been started yet.
+func (p *Pipeline) CopyToContainer(contID, dir string, files map[string][]byte, mode int64) error {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	archive := tar.NewWriter(buf)
+	for _, name := range names {
+		header := &tar.Header{
+			Name:     name,
+			Mode:     mode,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Now(),
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := archive.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	return p.Client.CopyToContainer(p.Context, contID, dir, buf, types.CopyToContainerOptions{})
+}
+
 // demuxDockerStream registers separate io.Pipes per StdOut and StdErr.
 // This code is based on implementation found in awslabs/aws-sam-local repo
 func demuxDockerStream(input io.Reader) (io.ReadCloser, io.ReadCloser) {
@@ -80,9 +170,7 @@ func demuxDockerStream(input io.Reader) (io.ReadCloser, io.ReadCloser) {
 }
 
 // LogWatch tails and reads logs from the container
-func (p *Pipeline) LogWatch(stdoutTxt, stderrTxt io.Reader, contID, logFileLocation string) {
-	var wg sync.WaitGroup
-
+func (p *Pipeline) LogWatch(stdoutTxt, stderrTxt io.Reader, logFileLocation string) {
 	stdout := io.Writer(os.Stdout)
 	stderr := io.Writer(os.Stderr)
 
@@ -96,6 +184,14 @@ func (p *Pipeline) LogWatch(stdoutTxt, stderrTxt io.Reader, contID, logFileLocat
 		}
 	}
 
+	p.LogCopy(stdoutTxt, stderrTxt, stdout, stderr)
+}
+
+// LogCopy reads logs from the container until they end and writes them to
+// the given writers
+func (p *Pipeline) LogCopy(stdoutTxt, stderrTxt io.Reader, stdout, stderr io.Writer) {
+	var wg sync.WaitGroup
+
 	wg.Add(1)
 	go func() {
 		io.Copy(stdout, stdoutTxt)
@@ -110,21 +206,123 @@ func (p *Pipeline) LogWatch(stdoutTxt, stderrTxt io.Reader, contID, logFileLocat
 
 	wg.Wait()
 	fmt.Fprintf(stderr, "\n")
-	p.CleanUp(contID)
 }
 
-// InterruptHandler register a handler of Interrupt signal (CTRL+C)
-func (p *Pipeline) InterruptHandler(stdout, stderr io.ReadCloser, contID string) {
-	sigCh := make(chan os.Signal, 2)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sigCh
+// ContainerExec runs the command in the running container, as the given user
+// (empty - the default user of the container) and with additional env
+// variables. It blocks until the command finishes and returns its exit code.
+func (p *Pipeline) ContainerExec(contID, user string, cmd, env []string, stdout, stderr io.Writer) (int, error) {
+	exec, err := p.Client.ContainerExecCreate(p.Context, contID, types.ExecConfig{
+		User:         user,
+		Env:          env,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	attach, err := p.Client.ContainerExecAttach(p.Context, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return -1, err
+	}
+	defer attach.Close()
+
+	if _, err := stdcopy.StdCopy(stdout, stderr, attach.Reader); err != nil {
+		return -1, err
+	}
+
+	inspect, err := p.Client.ContainerExecInspect(p.Context, exec.ID)
+	if err != nil {
+		return -1, err
+	}
+
+	return inspect.ExitCode, nil
+}
+
+// ContainerWait blocks until the container stops and returns its exit code
+func (p *Pipeline) ContainerWait(contID string) (int64, error) {
+	statusCh, errCh := p.Client.ContainerWait(p.Context, contID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return -1, err
+	case status := <-statusCh:
+		return status.StatusCode, nil
+	}
+}
+
+// interrupts holds clean-ups of all builds run by the process (i.e. removal
+// of their containers), a single handler of the Interrupt signal runs all of
+// them.
+var interrupts = struct {
+	sync.Mutex
+	cleanUps map[int]func()
+	next     int
+	stop     chan struct{}
+}{cleanUps: map[int]func(){}}
+
+// OnInterrupt registers a clean-up, which is run when the process gets
+// Interrupt signal (CTRL+C). Clean-ups are run in the reverse order of their
+// registration, then the process exits with 130. The returned function
+// releases the clean-up once it is no longer needed.
+func OnInterrupt(cleanUp func()) (release func()) {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+
+	id := interrupts.next
+	interrupts.next++
+	interrupts.cleanUps[id] = cleanUp
+
+	if len(interrupts.cleanUps) == 1 {
+		sigCh := make(chan os.Signal, 2)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		interrupts.stop = make(chan struct{})
+		go waitForInterrupt(sigCh, interrupts.stop)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			interrupts.Lock()
+			defer interrupts.Unlock()
+
+			delete(interrupts.cleanUps, id)
+			if len(interrupts.cleanUps) == 0 {
+				close(interrupts.stop)
+			}
+		})
+	}
+}
+
+// InterruptHandler makes sure the container is removed when the process gets
+// Interrupt signal (CTRL+C). The returned function releases the handler once
+// the build has ended.
+func (p *Pipeline) InterruptHandler(contID string) (release func()) {
+	return OnInterrupt(func() { p.CleanUp(contID) })
+}
+
+// waitForInterrupt runs all registered clean-ups and exits on Interrupt
+// signal, or stops listening for the signal once nothing is registered.
+func waitForInterrupt(sigCh chan os.Signal, stop chan struct{}) {
+	select {
+	case <-stop:
+		signal.Stop(sigCh)
+	case <-sigCh:
 		log.Printf("Received Interrupt signal, terminating...")
-		stderr.Close()
-		stdout.Close()
-		p.CleanUp(contID)
-		os.Exit(0)
-	}()
+
+		// The lock is kept, so no more clean-ups are registered or released
+		interrupts.Lock()
+		ids := []int{}
+		for id := range interrupts.cleanUps {
+			ids = append(ids, id)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+		for _, id := range ids {
+			interrupts.cleanUps[id]()
+		}
+		os.Exit(130)
+	}
 }
 
 // CleanUp removes the Docker container used by this runtime
@@ -3,6 +3,7 @@ package ci
 import (
 	"log"
 	"os"
+	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
@@ -34,6 +35,22 @@ func (p *Pipeline) PullImage(imageName string, force bool) error {
 	return nil
 }
 
+// ImageDigest returns digest of the image, as known by the registry or, for
+// images which were built locally, the image ID.
+func (p *Pipeline) ImageDigest(imageName string) (string, error) {
+	inspect, _, err := p.Client.ImageInspectWithRaw(p.Context, imageName)
+	if err != nil {
+		return "", err
+	}
+
+	if len(inspect.RepoDigests) > 0 {
+		digest := inspect.RepoDigests[0]
+		return digest[strings.LastIndex(digest, "@")+1:], nil
+	}
+
+	return inspect.ID, nil
+}
+
 // This code is based on implementation found in awslabs/aws-sam-local repo
 func (p *Pipeline) lookForExistingImage(imageName string) ([]types.ImageSummary, error) {
 	// Check if we have the required Docker image for this runtime
@@ -0,0 +1,75 @@
+package ci
+
+import (
+	"log"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// VolumeEnsure creates a named volume with given labels, unless the volume
+// already exists.
+func (p *Pipeline) VolumeEnsure(name string, labels map[string]string) error {
+	_, err := p.Client.VolumeInspect(p.Context, name)
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+
+	_, err = p.Client.VolumeCreate(p.Context, volumetypes.VolumeCreateBody{
+		Name:   name,
+		Labels: labels,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Created volume %s", name)
+	return nil
+}
+
+// VolumeList returns volumes which have all given labels. A label with an
+// empty value matches volumes with any value of that label.
+func (p *Pipeline) VolumeList(labels map[string]string) ([]*types.Volume, error) {
+	filter := filters.NewArgs()
+	for k, v := range labels {
+		if len(v) > 0 {
+			filter.Add("label", k+"="+v)
+		} else {
+			filter.Add("label", k)
+		}
+	}
+
+	list, err := p.Client.VolumeList(p.Context, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return list.Volumes, nil
+}
+
+// VolumeSizes returns disk usage (in bytes) of all volumes, by their names.
+// Volumes whose size cannot be computed by the Docker are omitted.
+func (p *Pipeline) VolumeSizes() (map[string]int64, error) {
+	usage, err := p.Client.DiskUsage(p.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	for _, v := range usage.Volumes {
+		if v.UsageData != nil && v.UsageData.Size >= 0 {
+			sizes[v.Name] = v.UsageData.Size
+		}
+	}
+	return sizes, nil
+}
+
+// VolumeRemove removes the volume, it fails if the volume is still in use
+func (p *Pipeline) VolumeRemove(name string) error {
+	return p.Client.VolumeRemove(p.Context, name, false)
+}
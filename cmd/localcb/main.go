@@ -18,6 +18,8 @@ func main() {
 	app.Commands = []cli.Command{
 		codebuild.BuildCommand(),
 		codebuild.RunCommand(),
+		codebuild.ValidateCommand(),
+		codebuild.CacheCommand(),
 	}
 
 	err := app.Run(os.Args)
@@ -0,0 +1,402 @@
+package codebuild
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/awslabs/goformation/cloudformation"
+)
+
+// Packaging types of the artifacts
+const (
+	PackagingZip  = "ZIP"
+	PackagingNone = "NONE"
+)
+
+// ArtifactFile is a file from the workspace which is a part of the artifact
+type ArtifactFile struct {
+	// Source is a location of the file on the host
+	Source string
+	// Target is a path of the file inside the artifact
+	Target string
+	// Symlink tells whether the file is saved as a symlink
+	Symlink bool
+}
+
+// Collect resolves files defined in the artifact against the build workspace.
+// Paths inside the artifact are relative to the base-directory, unless
+// discard-paths is enabled. It fails when discarding paths leaves two files
+// with the same path.
+func (a Artifacts) Collect(workspace string) ([]ArtifactFile, error) {
+	paths, err := a.List(workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	baseDir := filepath.Join(workspace, a.BaseDirectory)
+
+	files := []ArtifactFile{}
+	targets := map[string]string{}
+	for _, rel := range paths {
+		if a.excluded(rel) {
+			continue
+		}
+
+		source := filepath.Join(baseDir, filepath.FromSlash(rel))
+		target := rel
+		if a.discardPaths() {
+			target = path.Base(rel)
+			if other, ok := targets[target]; ok {
+				return nil, fmt.Errorf("artifact files %s and %s have the same name %s with discard-paths: yes", other, rel, target)
+			}
+			targets[target] = rel
+		}
+
+		file := ArtifactFile{Source: source, Target: target}
+		if a.yes(a.EnableSymlinks) {
+			if info, err := os.Lstat(source); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				file.Symlink = true
+			}
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// excluded tells whether the path (relative to the base-directory) matches
+// any of the exclude-paths.
+func (a Artifacts) excluded(rel string) bool {
+	for _, pattern := range a.ExcludePaths {
+		if matchGlobOrParent(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// discardPaths tells whether directory structure of the files is flattened.
+func (a Artifacts) discardPaths() bool {
+	return a.yes(a.DiscardPaths)
+}
+
+// yes checks the yes/no value of the buildspec. YAML parser turns unquoted yes
+// into true, so both of them are accepted.
+func (a Artifacts) yes(value string) bool {
+	switch strings.ToLower(value) {
+	case "yes", "true":
+		return true
+	}
+	return false
+}
+
+// CollectedArtifact describes an artifact saved on the host
+type CollectedArtifact struct {
+	// Identifier is empty for the primary artifact
+	Identifier string
+	Location   string
+	Manifest   string
+}
+
+// SelectSecondaryArtifacts configures the project to produce secondary
+// artifacts with given identifiers (all of them, when none is given). They
+// are saved next to the primary artifact, with the same packaging.
+func (cb *CodeBuild) SelectSecondaryArtifacts(identifiers []string) error {
+	defined := cb.Definition.Artifacts.SecondaryArtifacts
+	if len(identifiers) == 0 {
+		for id := range defined {
+			identifiers = append(identifiers, id)
+		}
+		sort.Strings(identifiers)
+	}
+
+	cb.Project.SecondaryArtifacts = nil
+	for _, id := range identifiers {
+		if _, ok := defined[id]; !ok {
+			return fmt.Errorf("unknown secondary artifact identifier (%s)", id)
+		}
+
+		cb.Project.SecondaryArtifacts = append(cb.Project.SecondaryArtifacts, cloudformation.AWSCodeBuildProject_Artifacts{
+			ArtifactIdentifier: id,
+			Type:               cb.Project.Artifacts.Type,
+			Location:           cb.Project.Artifacts.Location,
+			Packaging:          cb.Project.Artifacts.Packaging,
+		})
+	}
+
+	return nil
+}
+
+// CollectArtifacts saves files defined in the `artifacts` section to the
+// location of the project artifacts, followed by the selected secondary
+// artifacts. Each artifact is accompanied by a manifest with the provenance.
+// Nothing is collected when the project does not produce artifacts.
+func (cb *CodeBuild) CollectArtifacts(p Provenance) ([]CollectedArtifact, error) {
+	a := cb.Project.Artifacts
+	if a == nil || a.Type == "NO_ARTIFACTS" {
+		return nil, nil
+	}
+
+	collected := []CollectedArtifact{}
+	if cb.Definition.Artifacts.Files != nil {
+		artifact, err := cb.collectArtifact(cb.Definition.Artifacts, *a, a.Name, p)
+		if err != nil {
+			return nil, err
+		}
+		collected = append(collected, artifact)
+	}
+
+	for _, secondary := range cb.Project.SecondaryArtifacts {
+		id := secondary.ArtifactIdentifier
+		artifact, err := cb.collectArtifact(cb.Definition.Artifacts.SecondaryArtifacts[id], secondary, id, p)
+		if err != nil {
+			return nil, fmt.Errorf("secondary artifact %s: %s", id, err)
+		}
+		collected = append(collected, artifact)
+	}
+
+	return collected, nil
+}
+
+// collectArtifact saves a single artifact, which is named after the name from
+// the buildspec or the defaultName, and its manifest.
+func (cb *CodeBuild) collectArtifact(def Artifacts, output cloudformation.AWSCodeBuildProject_Artifacts, defaultName string, p Provenance) (CollectedArtifact, error) {
+	artifact := CollectedArtifact{Identifier: output.ArtifactIdentifier}
+
+	name := defaultName
+	if len(def.Name) > 0 {
+		name = def.Name
+	}
+
+	files, err := def.Collect(cb.Project.Source.Location)
+	if err != nil {
+		return artifact, err
+	}
+	files = cb.withoutGenerated(files)
+
+	artifact.Location, err = packageArtifact(files, output.Location, name, output.Packaging)
+	if err != nil {
+		return artifact, err
+	}
+
+	artifact.Manifest, err = WriteManifest(artifact, files, p)
+	return artifact, err
+}
+
+// generatedFiles match names of the files, which the localcb writes into the
+// source directory by default (also for the builds of the batch)
+var generatedFiles = []string{
+	"localcb.sh",
+	"localcb-*.sh",
+	"localcb-exported-variables*.json",
+	"localcb-reports*.json",
+	"localcb-commands*.json",
+}
+
+// withoutGenerated leaves out files written by the localcb itself, so outputs
+// of the previous builds do not end up in the artifacts
+func (cb *CodeBuild) withoutGenerated(files []ArtifactFile) []ArtifactFile {
+	workspace, _ := filepath.Abs(cb.Project.Source.Location)
+
+	generated := []string{}
+	for _, p := range cb.GeneratedPaths {
+		if len(p) == 0 {
+			continue
+		}
+		if abs, err := filepath.Abs(p); err == nil {
+			generated = append(generated, abs)
+		}
+	}
+
+	kept := []ArtifactFile{}
+	for _, f := range files {
+		if !isGenerated(f.Source, workspace, generated) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+func isGenerated(source, workspace string, generated []string) bool {
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return false
+	}
+
+	if filepath.Dir(abs) == workspace {
+		for _, pattern := range generatedFiles {
+			if ok, _ := filepath.Match(pattern, filepath.Base(abs)); ok {
+				return true
+			}
+		}
+	}
+
+	for _, p := range generated {
+		if abs == p || strings.HasPrefix(abs, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// packageArtifact writes files as a ZIP archive or a directory (NONE packaging)
+// named after the artifact in the output directory.
+func packageArtifact(files []ArtifactFile, outputDir, name, packaging string) (string, error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", err
+	}
+
+	switch strings.ToUpper(packaging) {
+	case PackagingZip:
+		if !strings.HasSuffix(name, ".zip") {
+			name += ".zip"
+		}
+		location := filepath.Join(outputDir, name)
+		return location, writeZip(files, location)
+	case PackagingNone, "":
+		location := filepath.Join(outputDir, name)
+		return location, writeDirectory(files, outputDir, location)
+	}
+
+	return "", fmt.Errorf("unknown packaging (%s), expected ZIP or NONE", packaging)
+}
+
+func writeZip(files []ArtifactFile, location string) error {
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(location)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	archive := zip.NewWriter(f)
+	for _, file := range files {
+		if err := addToZip(archive, file); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func addToZip(archive *zip.Writer, file ArtifactFile) error {
+	stat := os.Stat
+	if file.Symlink {
+		stat = os.Lstat
+	}
+	info, err := stat(file.Source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = file.Target
+	header.Method = zip.Deflate
+
+	w, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	// Symlinks are stored as entries which content is the link target
+	if file.Symlink {
+		target, err := os.Readlink(file.Source)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, target)
+		return err
+	}
+
+	src, err := os.Open(file.Source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// writeDirectory copies files to the location, which is cleaned up first to
+// not mix files from previous builds.
+func writeDirectory(files []ArtifactFile, outputDir, location string) error {
+	if rel, err := filepath.Rel(outputDir, location); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("artifact location %s must be inside %s", location, outputDir)
+	}
+	if err := os.RemoveAll(location); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		target := filepath.Join(location, filepath.FromSlash(file.Target))
+		if file.Symlink {
+			if err := copySymlink(file.Source, target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyFile(file.Source, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copySymlink(source, target string) error {
+	link, err := os.Readlink(source)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	return os.Symlink(link, target)
+}
+
+func copyFile(source, target string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
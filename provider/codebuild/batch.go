@@ -0,0 +1,415 @@
+package codebuild
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/awslabs/goformation/cloudformation"
+	"github.com/piotrkubisa/localcb/ci"
+	"github.com/pkg/errors"
+)
+
+// Batch describes contents specified in top-root `batch` key of the
+// `buildspec.yml` file, which is used only by the batch builds.
+type Batch struct {
+	// FastFail stops builds which have not started yet after the first
+	// failed build
+	FastFail    bool         `json:"fast-fail"`
+	BuildList   []BatchBuild `json:"build-list"`
+	BuildMatrix *BuildMatrix `json:"build-matrix"`
+	BuildGraph  []BatchBuild `json:"build-graph"`
+	BuildFanout *BuildFanout `json:"build-fanout"`
+}
+
+// BatchBuild describes a single build of the batch
+type BatchBuild struct {
+	Identifier string   `json:"identifier"`
+	Env        BatchEnv `json:"env"`
+	// Buildspec overrides the buildspec, path is relative to the source
+	// directory (empty - the same buildspec is used)
+	Buildspec string `json:"buildspec"`
+	// IgnoreFailure lets the batch succeed even if this build fails, builds
+	// which depend on it are run anyway
+	IgnoreFailure bool `json:"ignore-failure"`
+	// DependOn lists identifiers of the builds which have to finish before
+	// this build starts (only in the build graph)
+	DependOn []string `json:"depend-on"`
+
+	// Combination describes values of the build matrix used by the build
+	Combination string `json:"-"`
+	// Shard is a number of the build in the build fanout (0 - not a shard)
+	Shard int `json:"-"`
+}
+
+// Name returns the identifier of the build, followed by its combination of
+// the build matrix values.
+func (bb BatchBuild) Name() string {
+	if len(bb.Combination) == 0 {
+		return bb.Identifier
+	}
+
+	return bb.Identifier + " (" + bb.Combination + ")"
+}
+
+// BatchEnv overrides the environment of the project in the batch build
+type BatchEnv struct {
+	Image          string            `json:"image"`
+	ComputeType    string            `json:"compute-type"`
+	Type           string            `json:"type"`
+	PrivilegedMode *bool             `json:"privileged-mode"`
+	Variables      map[string]string `json:"variables"`
+}
+
+// Statuses of the builds in the batch
+const (
+	BuildSucceeded = ci.NodeSucceeded
+	BuildFailed    = ci.NodeFailed
+	BuildStopped   = ci.NodeStopped
+	// BuildSkipped is not run, because a build it depends on has failed
+	BuildSkipped = ci.NodeSkipped
+)
+
+var batchIdentifier = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Builds returns builds of the batch, once their identifiers are checked to be
+// valid and unique and dependencies of the build graph to be known and not to
+// form a cycle. Builds of the build matrix and shards of the build fanout are
+// named as in the AWS CodeBuild: build1, build2 and so on.
+func (b Batch) Builds() ([]BatchBuild, error) {
+	defined := []string{}
+	if len(b.BuildList) > 0 {
+		defined = append(defined, "build-list")
+	}
+	if b.BuildMatrix != nil {
+		defined = append(defined, "build-matrix")
+	}
+	if len(b.BuildGraph) > 0 {
+		defined = append(defined, "build-graph")
+	}
+	if b.BuildFanout != nil {
+		defined = append(defined, "build-fanout")
+	}
+
+	switch {
+	case len(defined) > 1:
+		return nil, fmt.Errorf("batch defines %s, only one of them can be used", strings.Join(defined, " and "))
+	case len(defined) == 0:
+		return nil, errors.New("batch does not define any build, expected build-list, build-matrix, build-graph or build-fanout")
+	case b.BuildMatrix != nil:
+		return b.BuildMatrix.Builds(), nil
+	case b.BuildFanout != nil:
+		return b.BuildFanout.Builds()
+	}
+
+	builds, section := b.BuildList, "build-list"
+	if len(b.BuildGraph) > 0 {
+		builds, section = b.BuildGraph, "build-graph"
+	}
+
+	seen := map[string]bool{}
+	for i, bb := range builds {
+		if !batchIdentifier.MatchString(bb.Identifier) {
+			return nil, fmt.Errorf("batch.%s[%d]: identifier %q must consist of letters, digits and underscores", section, i, bb.Identifier)
+		}
+		if seen[bb.Identifier] {
+			return nil, fmt.Errorf("batch.%s[%d]: identifier %s is not unique", section, i, bb.Identifier)
+		}
+		seen[bb.Identifier] = true
+
+		if section != "build-graph" && len(bb.DependOn) > 0 {
+			return nil, fmt.Errorf("batch.%s[%d]: depend-on can be used only in the build-graph", section, i)
+		}
+	}
+
+	if _, err := batchGraph(builds); err != nil {
+		return nil, fmt.Errorf("batch.%s: %s", section, err)
+	}
+
+	return builds, nil
+}
+
+// SelectBuilds returns builds with the given identifiers (all of them, when
+// none is given). Dependencies on builds which are not selected are dropped,
+// as if these builds have already succeeded.
+func SelectBuilds(builds []BatchBuild, identifiers []string) ([]BatchBuild, error) {
+	if len(identifiers) == 0 {
+		return builds, nil
+	}
+
+	byID := map[string]BatchBuild{}
+	known := []string{}
+	for _, bb := range builds {
+		byID[bb.Identifier] = bb
+		known = append(known, bb.Identifier)
+	}
+
+	isSelected := map[string]bool{}
+	for _, id := range identifiers {
+		if _, ok := byID[id]; !ok {
+			return nil, fmt.Errorf("unknown batch build identifier (%s), expected one of: %s", id, strings.Join(known, ", "))
+		}
+		isSelected[id] = true
+	}
+
+	selected := []BatchBuild{}
+	for _, bb := range builds {
+		if !isSelected[bb.Identifier] {
+			continue
+		}
+
+		deps := []string{}
+		for _, dep := range bb.DependOn {
+			if isSelected[dep] {
+				deps = append(deps, dep)
+			}
+		}
+		bb.DependOn = deps
+		selected = append(selected, bb)
+	}
+	return selected, nil
+}
+
+// Project returns a copy of the project with the environment and the buildspec
+// overridden by the batch build. Artifacts of the build are saved in its own
+// directory, named after the identifier.
+func (bb BatchBuild) Project(project cloudformation.AWSCodeBuildProject) cloudformation.AWSCodeBuildProject {
+	env := *project.Environment
+	if len(bb.Env.Image) > 0 {
+		env.Image = bb.Env.Image
+	}
+	if len(bb.Env.ComputeType) > 0 {
+		env.ComputeType = bb.Env.ComputeType
+	}
+	if len(bb.Env.Type) > 0 {
+		env.Type = bb.Env.Type
+	}
+	if bb.Env.PrivilegedMode != nil {
+		env.PrivilegedMode = *bb.Env.PrivilegedMode
+	}
+	project.Environment = &env
+
+	source := *project.Source
+	if len(bb.Buildspec) > 0 {
+		source.BuildSpec = filepath.Join(source.Location, bb.Buildspec)
+	}
+	project.Source = &source
+
+	if project.Artifacts != nil && project.Artifacts.Type != "NO_ARTIFACTS" {
+		artifacts := *project.Artifacts
+		artifacts.Location = filepath.Join(artifacts.Location, bb.Identifier)
+		project.Artifacts = &artifacts
+	}
+
+	return project
+}
+
+// NewBatchCodeBuild creates CodeBuild runtime of the build in the batch.
+// Variables of the batch build override variables of the buildspec.
+func NewBatchCodeBuild(project cloudformation.AWSCodeBuildProject, bb BatchBuild) (*CodeBuild, error) {
+	cb, err := NewCodeBuild(bb.Project(project))
+	if err != nil {
+		return nil, errors.Wrapf(err, "localcb: batch build %s", bb.Identifier)
+	}
+	cb.BatchIdentifier = bb.Identifier
+	cb.Shard = bb.Shard
+
+	if len(bb.Env.Variables) > 0 && cb.Definition.Env.Variables == nil {
+		cb.Definition.Env.Variables = map[string]string{}
+	}
+	for k, v := range bb.Env.Variables {
+		cb.Definition.Env.Variables[k] = v
+	}
+
+	return cb, nil
+}
+
+// CopySource replaces the source directory with its temporary copy, so builds
+// of the batch running at the same time do not overwrite files of each other
+// (i.e. test reports or artifacts). Files written by the localcb are not
+// copied. The returned function removes the copy.
+func (cb *CodeBuild) CopySource() (func(), error) {
+	files, err := Artifacts{
+		Files:          []string{"**/*"},
+		DiscardPaths:   "no",
+		EnableSymlinks: "yes",
+	}.Collect(cb.Project.Source.Location)
+	if err != nil {
+		return nil, err
+	}
+	files = cb.withoutGenerated(files)
+
+	tmp, err := ioutil.TempDir("", "localcb-"+cb.BatchIdentifier+"-")
+	if err != nil {
+		return nil, err
+	}
+	removeCopy := func() { os.RemoveAll(tmp) }
+
+	location := filepath.Join(tmp, "src")
+	if err := writeDirectory(files, tmp, location); err != nil {
+		removeCopy()
+		return nil, err
+	}
+	cb.Project.Source.Location = location
+
+	return removeCopy, nil
+}
+
+// batchFileName puts the identifier of the batch build into the file name,
+// i.e. localcb-unit_tests.sh for localcb.sh
+func batchFileName(name, identifier string) string {
+	if len(name) == 0 || len(identifier) == 0 {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + identifier + ext
+}
+
+// BatchResult describes result of a single build of the batch
+type BatchResult struct {
+	Identifier    string
+	Combination   string
+	IgnoreFailure bool
+	Status        string
+	Summary       RunSummary
+
+	// Err explains why the build has failed
+	Err error
+}
+
+// Failed tells whether the build fails the whole batch
+func (r BatchResult) Failed() bool {
+	return r.Status != BuildSucceeded && !(r.Status == BuildFailed && r.IgnoreFailure)
+}
+
+// BatchSummary describes results of all builds of the batch
+type BatchSummary struct {
+	Results []BatchResult
+	// Reports merge reports of the shards of the build fanout
+	Reports []Report
+}
+
+// batchGraph returns a graph of the builds, builds of a list or a matrix do
+// not depend on each other.
+func batchGraph(builds []BatchBuild) (*ci.Graph, error) {
+	nodes := []ci.Node{}
+	for _, bb := range builds {
+		nodes = append(nodes, ci.Node{
+			ID:            bb.Identifier,
+			DependsOn:     bb.DependOn,
+			IgnoreFailure: bb.IgnoreFailure,
+		})
+	}
+
+	return ci.NewGraph(nodes)
+}
+
+// RunBatch runs builds of the batch in the order of their dependencies, at
+// most concurrency of them at the same time (less than 1 - as many as CPUs).
+// Builds which depend on a failed build are skipped, unless its failure is
+// ignored. With fastFail builds which have not started yet are stopped after
+// the first failed build.
+func RunBatch(builds []BatchBuild, concurrency int, fastFail bool, run func(BatchBuild) (RunSummary, error)) (BatchSummary, error) {
+	graph, err := batchGraph(builds)
+	if err != nil {
+		return BatchSummary{}, err
+	}
+
+	results := map[string]BatchResult{}
+	byID := map[string]BatchBuild{}
+	for _, bb := range builds {
+		byID[bb.Identifier] = bb
+	}
+
+	var mu sync.Mutex
+	statuses := graph.Run(concurrency, fastFail, func(id string) error {
+		r := byID[id].result(BuildSucceeded)
+		r.Summary, r.Err = run(byID[id])
+		if r.Err == nil {
+			r.Err = r.Summary.Err()
+		}
+
+		mu.Lock()
+		results[id] = r
+		mu.Unlock()
+		return r.Err
+	})
+
+	summary := BatchSummary{}
+	for _, bb := range builds {
+		r, ok := results[bb.Identifier]
+		if !ok {
+			r = bb.result("")
+		}
+		r.Status = statuses[bb.Identifier]
+		summary.Results = append(summary.Results, r)
+	}
+	return summary, nil
+}
+
+func (bb BatchBuild) result(status string) BatchResult {
+	return BatchResult{
+		Identifier:    bb.Identifier,
+		Combination:   bb.Combination,
+		IgnoreFailure: bb.IgnoreFailure,
+		Status:        status,
+	}
+}
+
+// Err returns an error when any of the builds fails the batch
+func (s BatchSummary) Err() error {
+	failed := []string{}
+	for _, r := range s.Results {
+		if r.Failed() {
+			failed = append(failed, r.Identifier)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("localcb: batch failed, %d build(s) did not succeed: %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	if violations := CoverageViolations(s.Reports); len(violations) > 0 {
+		return fmt.Errorf("localcb: batch failed, code coverage thresholds not met in %s", strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// Print writes the summary in a human-readable form
+func (s BatchSummary) Print(w io.Writer) {
+	status := BuildSucceeded
+	if s.Err() != nil {
+		status = BuildFailed
+	}
+
+	fmt.Fprintf(w, "[Container] Batch summary\n")
+	fmt.Fprintf(w, "  Status: %s\n", status)
+	for _, r := range s.Results {
+		if r.Status == BuildFailed && r.IgnoreFailure {
+			fmt.Fprintf(w, "  %s: %s (failure ignored)\n", r.Identifier, r.Status)
+		} else {
+			fmt.Fprintf(w, "  %s: %s\n", r.Identifier, r.Status)
+		}
+		if len(r.Combination) > 0 {
+			fmt.Fprintf(w, "    Combination: %s\n", r.Combination)
+		}
+		if r.Err != nil {
+			fmt.Fprintf(w, "    %s\n", r.Err)
+		}
+		for _, a := range r.Summary.Artifacts {
+			fmt.Fprintf(w, "    Artifact: %s\n", a.Location)
+		}
+	}
+	if len(s.Reports) > 0 {
+		fmt.Fprintf(w, "  Merged reports:\n")
+		for _, r := range s.Reports {
+			r.Print(w)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package codebuild
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BuildFanout describes the `batch.build-fanout` of the `buildspec.yml` file.
+// The same build runs in parallel shards, which split tests between them with
+// the codebuild-tests-run command.
+type BuildFanout struct {
+	Parallelism   int  `json:"parallelism"`
+	IgnoreFailure bool `json:"ignore-failure"`
+}
+
+// Builds returns a build per shard, each of them knows its number and the
+// total number of shards from the CODEBUILD_CURRENT_SHARD_NUMBER and
+// CODEBUILD_TOTAL_SHARDS variables.
+func (f BuildFanout) Builds() ([]BatchBuild, error) {
+	if f.Parallelism < 1 {
+		return nil, fmt.Errorf("batch.build-fanout: parallelism must be at least 1, got %d", f.Parallelism)
+	}
+
+	builds := []BatchBuild{}
+	for i := 1; i <= f.Parallelism; i++ {
+		builds = append(builds, BatchBuild{
+			Identifier:    fmt.Sprintf("build%d", i),
+			IgnoreFailure: f.IgnoreFailure,
+			Env: BatchEnv{Variables: map[string]string{
+				"CODEBUILD_CURRENT_SHARD_NUMBER": strconv.Itoa(i),
+				"CODEBUILD_TOTAL_SHARDS":         strconv.Itoa(f.Parallelism),
+			}},
+			Combination: fmt.Sprintf("shard %d of %d", i, f.Parallelism),
+			Shard:       i,
+		})
+	}
+	return builds, nil
+}
+
+// MergeReports combines reports of the same report groups collected by the
+// shards into the summary. Report files are prefixed with the identifier of
+// the shard. Code coverage of the merged reports is checked against the
+// thresholds from the localcb config.
+func (s *BatchSummary) MergeReports(cfg Config) {
+	byName := map[string][]Report{}
+	shards := map[string][]string{}
+	for _, r := range s.Results {
+		for _, report := range r.Summary.Reports {
+			byName[report.Name] = append(byName[report.Name], report)
+			shards[report.Name] = append(shards[report.Name], r.Identifier)
+		}
+	}
+
+	names := []string{}
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s.Reports = []Report{}
+	for _, name := range names {
+		s.Reports = append(s.Reports, mergeReports(byName[name], shards[name]))
+	}
+	cfg.checkThresholds(s.Reports)
+}
+
+// mergeReports merges reports of a single report group, the report is
+// incomplete only when reports of all shards are.
+func mergeReports(reports []Report, shards []string) Report {
+	merged := Report{
+		Name:   reports[0].Name,
+		Type:   reports[0].Type,
+		Format: reports[0].Format,
+		Files:  []string{},
+	}
+
+	coverage := []FileCoverage{}
+	problems := []string{}
+	incomplete := 0
+	for i, r := range reports {
+		for _, f := range r.Files {
+			merged.Files = append(merged.Files, shards[i]+"/"+f)
+		}
+		for _, tc := range r.TestCases {
+			tc.File = shards[i] + "/" + tc.File
+			merged.TestCases = append(merged.TestCases, tc)
+		}
+		coverage = append(coverage, r.CodeCoverages...)
+
+		if r.Status == ReportIncomplete {
+			incomplete++
+		}
+		if len(r.Error) > 0 {
+			problems = append(problems, shards[i]+": "+r.Error)
+		}
+	}
+
+	merged.Status = ReportSucceeded
+	if merged.Type == ReportCodeCoverage {
+		merged.CodeCoverages = mergeFileCoverages(coverage)
+		merged.CoverageSummary = summarizeCoverage(merged.CodeCoverages)
+	} else {
+		merged.Summary = summarizeTests(merged.TestCases)
+		if merged.Summary.StatusCounts[TestFailed]+merged.Summary.StatusCounts[TestError] > 0 {
+			merged.Status = ReportFailed
+		}
+	}
+
+	if len(problems) > 0 {
+		merged.Error = strings.Join(problems, "; ")
+	}
+	if incomplete == len(reports) {
+		merged.Status = ReportIncomplete
+		if merged.Type == ReportCodeCoverage {
+			merged.CodeCoverages, merged.CoverageSummary = nil, nil
+		}
+	}
+	return merged
+}
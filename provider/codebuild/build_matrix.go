@@ -0,0 +1,107 @@
+package codebuild
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BuildMatrix describes the `batch.build-matrix` of the `buildspec.yml` file.
+// Every combination of the dynamic values becomes a separate build, which
+// shares the static settings.
+type BuildMatrix struct {
+	Static  BatchBuild    `json:"static"`
+	Dynamic MatrixDynamic `json:"dynamic"`
+}
+
+// MatrixDynamic lists values of the build matrix dimensions
+type MatrixDynamic struct {
+	Buildspec []string  `json:"buildspec"`
+	Env       MatrixEnv `json:"env"`
+}
+
+// MatrixEnv lists values of the environment in the build matrix, every
+// variable is a separate dimension.
+type MatrixEnv struct {
+	Image       []string            `json:"image"`
+	ComputeType []string            `json:"compute-type"`
+	Variables   map[string][]string `json:"variables"`
+}
+
+// matrixDimension sets a single value of the dimension in the build
+type matrixDimension struct {
+	name   string
+	values []string
+	apply  func(bb *BatchBuild, value string)
+}
+
+// dimensions returns dimensions of the matrix in the order in which they are
+// expanded: buildspec, image, compute-type and variables sorted by name.
+func (m BuildMatrix) dimensions() []matrixDimension {
+	dims := []matrixDimension{
+		{"buildspec", m.Dynamic.Buildspec, func(bb *BatchBuild, v string) { bb.Buildspec = v }},
+		{"image", m.Dynamic.Env.Image, func(bb *BatchBuild, v string) { bb.Env.Image = v }},
+		{"compute-type", m.Dynamic.Env.ComputeType, func(bb *BatchBuild, v string) { bb.Env.ComputeType = v }},
+	}
+
+	names := []string{}
+	for name := range m.Dynamic.Env.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		name := name
+		dims = append(dims, matrixDimension{name, m.Dynamic.Env.Variables[name], func(bb *BatchBuild, v string) {
+			bb.Env.Variables[name] = v
+		}})
+	}
+
+	return dims
+}
+
+// Builds expands the matrix into builds, one per combination of the dynamic
+// values. The last dimension changes first, so builds of the same buildspec
+// stay next to each other.
+func (m BuildMatrix) Builds() []BatchBuild {
+	static := m.Static
+	static.Identifier = ""
+	builds := []BatchBuild{static}
+	combinations := [][]string{{}}
+
+	for _, dim := range m.dimensions() {
+		if len(dim.values) == 0 {
+			continue
+		}
+
+		expanded := []BatchBuild{}
+		expandedCombinations := [][]string{}
+		for i, bb := range builds {
+			for _, v := range dim.values {
+				b := bb.copy()
+				dim.apply(&b, v)
+				expanded = append(expanded, b)
+
+				c := append(append([]string{}, combinations[i]...), dim.name+"="+v)
+				expandedCombinations = append(expandedCombinations, c)
+			}
+		}
+		builds, combinations = expanded, expandedCombinations
+	}
+
+	for i := range builds {
+		builds[i].Identifier = fmt.Sprintf("build%d", i+1)
+		builds[i].Combination = strings.Join(combinations[i], ", ")
+	}
+	return builds
+}
+
+// copy returns a copy of the build, which variables can be changed
+func (bb BatchBuild) copy() BatchBuild {
+	vars := map[string]string{}
+	for k, v := range bb.Env.Variables {
+		vars[k] = v
+	}
+	bb.Env.Variables = vars
+
+	return bb
+}
@@ -1,8 +1,14 @@
 package codebuild
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/piotrkubisa/localcb/ci"
 	"github.com/sanathkr/yaml"
 )
 
@@ -12,12 +18,17 @@ import (
 // - https://docs.aws.amazon.com/codebuild/latest/userguide/build-spec-ref.html
 type BuildSpec struct {
 	Version   string    `json:"version"`
+	RunAs     string    `json:"run-as"`
 	Env       Env       `json:"env"`
 	Phases    Phases    `json:"phases"`
 	Artifacts Artifacts `json:"artifacts"`
+	Cache     Cache     `json:"cache"`
 
-	// Cache is not supported
-	// Cache     interface{}     `json:"cache"`
+	// Reports maps names (or ARNs) of the report groups to their definitions
+	Reports map[string]ReportGroup `json:"reports"`
+
+	// Batch is used only when the builds of the batch are run (--batch)
+	Batch Batch `json:"batch"`
 }
 
 // ParseBuildSpec unmarshals contents of the `buildspec.yml` file to the newly-
@@ -33,16 +44,34 @@ func ParseBuildSpec(filePath string) (bs BuildSpec, err error) {
 		return bs, err
 	}
 
+	// Versions like 3.0 are numbers in YAML, so they are read again as written
+	bs.Phases.Install.RuntimeVersions, err = parseRuntimeVersions(contents)
+	if err != nil {
+		return bs, err
+	}
+
 	return bs, nil
 }
 
 // Env describes contents specified in top-root `env` key of the `builspec.yml`
 // file.
 type Env struct {
+	// Shell runs the build commands: bash, sh (default) or a path to the
+	// shell executable
+	Shell     string            `json:"shell"`
 	Variables map[string]string `json:"variables"`
 
-	// TODO; ParameterStore is not supported right now, so make it work :)
-	// ParameterStore map[string]string `json:"parameter-store"`
+	// ParameterStore maps env variables to names of the parameters, which are
+	// resolved from the local ParameterStore
+	ParameterStore map[string]string `json:"parameter-store"`
+
+	// SecretsManager maps env variables to references of the secrets, which
+	// are resolved from the local SecretsManager
+	SecretsManager map[string]string `json:"secrets-manager"`
+
+	// ExportedVariables lists env variables which values are captured at
+	// the end of the build
+	ExportedVariables []string `json:"exported-variables"`
 }
 
 // Phases describes contents specified in top-root `phases` key
@@ -55,27 +84,219 @@ type Phases struct {
 }
 
 // Phase provides command list which will be run during the build.
+// Commands listed in Finally are run after Commands, even if any of them fail.
 type Phase struct {
-	Commands []string `json:"commands"`
+	RunAs     string   `json:"run-as"`
+	OnFailure string   `json:"on-failure"` // ABORT (default) or CONTINUE
+	Commands  []string `json:"commands"`
+	Finally   []string `json:"finally"`
+
+	// RuntimeVersions is supported only in the install phase
+	RuntimeVersions map[string]string `json:"runtime-versions"`
+}
+
+// FailureAction returns what the build should do when the phase fails.
+func (p Phase) FailureAction() (ci.FailureAction, error) {
+	switch p.OnFailure {
+	case "", "ABORT":
+		return ci.Abort, nil
+	case "CONTINUE":
+		return ci.Continue, nil
+	}
+
+	return ci.Abort, fmt.Errorf("unknown on-failure value (%s), expected ABORT or CONTINUE", p.OnFailure)
 }
 
 // Artifacts describes contents specified in top-root `artifacts` key
 // of the `buildspec.yml` file.
 type Artifacts struct {
+	Name          string      `json:"name"`
 	Files         interface{} `json:"files"`
 	DiscardPaths  string      `json:"discard-paths"` // default=yes
 	BaseDirectory string      `json:"base-directory"`
+
+	// ExcludePaths lists patterns (relative to the base-directory) of files
+	// which are not a part of the artifact
+	ExcludePaths []string `json:"exclude-paths"`
+	// EnableSymlinks keeps symlinks as they are, instead of their targets
+	EnableSymlinks string `json:"enable-symlinks"`
+
+	// SecondaryArtifacts maps artifact identifiers to their definitions
+	SecondaryArtifacts map[string]Artifacts `json:"secondary-artifacts"`
+}
+
+// ReportGroup describes a single entry of the top-root `reports` key of the
+// `buildspec.yml` file.
+type ReportGroup struct {
+	Files         []string `json:"files"`
+	BaseDirectory string   `json:"base-directory"`
+	DiscardPaths  string   `json:"discard-paths"`
+	FileFormat    string   `json:"file-format"` // default=JUNITXML
+}
+
+// Cache describes contents specified in top-root `cache` key of the
+// `buildspec.yml` file.
+type Cache struct {
+	// Paths lists patterns of files (absolute or relative to the source
+	// directory) which are kept between the builds
+	Paths []string `json:"paths"`
 }
 
-// List returns list of files defined in the OutputArtifact
-func (a Artifacts) List() ([]string, error) {
+// Patterns returns glob patterns defined in the `files` of the artifact
+func (a Artifacts) Patterns() ([]string, error) {
 	switch a.Files.(type) {
 	case string:
-		// TODO: Apply glob-pattern here
 		return []string{a.Files.(string)}, nil
 	case []string:
 		return a.Files.([]string), nil
+	case []interface{}:
+		files := []string{}
+		for _, f := range a.Files.([]interface{}) {
+			s, ok := f.(string)
+			if !ok {
+				return nil, fmt.Errorf("artifacts.files must be a list of strings, got %v", f)
+			}
+			files = append(files, s)
+		}
+		return files, nil
 	}
 
 	return []string{}, nil
 }
+
+// List returns files of the workspace matched by the artifact patterns, as
+// slash-separated paths relative to the base-directory. Patterns follow the
+// CodeBuild rules: `**` matches any number of directories (so `**/*` matches
+// all files) and a matched directory includes all files inside of it. Unless
+// enable-symlinks is set, symlinks to directories are followed. It fails when
+// any of the patterns does not match anything.
+func (a Artifacts) List(workspace string) ([]string, error) {
+	patterns, err := a.Patterns()
+	if err != nil {
+		return nil, err
+	}
+
+	files, unmatched, err := listFiles(workspace, a.BaseDirectory, patterns, !a.yes(a.EnableSymlinks))
+	if err != nil {
+		return nil, err
+	}
+	if len(unmatched) > 0 {
+		return nil, fmt.Errorf("no matching artifact paths found for pattern %s in %s", unmatched[0], filepath.Join(workspace, a.BaseDirectory))
+	}
+
+	return files, nil
+}
+
+// listFiles returns files below the baseDirectory of the workspace matched by
+// the patterns (see Artifacts.List) and patterns which did not match anything.
+func listFiles(workspace, baseDirectory string, patterns []string, followLinks bool) ([]string, []string, error) {
+	baseDir := filepath.Join(workspace, baseDirectory)
+	entries, err := walkWorkspace(baseDir, followLinks)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read base-directory %s: %s", baseDirectory, err)
+	}
+
+	files := []string{}
+	unmatched := []string{}
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(path.Clean(filepath.ToSlash(pattern)), "./")
+
+		matched := false
+		for i, e := range entries {
+			if !matchGlob(pattern, e.path) {
+				continue
+			}
+			matched = true
+
+			for _, f := range filesBelow(entries, i) {
+				if !seen[f] {
+					seen[f] = true
+					files = append(files, f)
+				}
+			}
+		}
+
+		if !matched {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+
+	return files, unmatched, nil
+}
+
+// workspaceEntry is a file or a directory found in the workspace
+type workspaceEntry struct {
+	path  string
+	isDir bool
+}
+
+// filesBelow returns the i-th entry or, for directories, all files inside.
+// Entries of the directory directly follow it, as they are walked in order.
+func filesBelow(entries []workspaceEntry, i int) []string {
+	dir := entries[i]
+	if !dir.isDir {
+		return []string{dir.path}
+	}
+
+	files := []string{}
+	for _, e := range entries[i+1:] {
+		if !strings.HasPrefix(e.path, dir.path+"/") {
+			break
+		}
+		if !e.isDir {
+			files = append(files, e.path)
+		}
+	}
+	return files
+}
+
+// walkWorkspace lists all files and directories (in lexical order) below the
+// root. Symlinks to directories are followed only with followLinks, then files
+// of the target directory are listed below the symlink.
+func walkWorkspace(root string, followLinks bool) ([]workspaceEntry, error) {
+	entries := []workspaceEntry{}
+	err := walkDirectory(root, "", followLinks, map[string]bool{}, &entries)
+
+	return entries, err
+}
+
+// walkDirectory appends entries of the directory, rel is its path relative to
+// the root. Directories which are already being walked (parents) are skipped,
+// so a symlink pointing to its parent does not make a loop.
+func walkDirectory(dir, rel string, followLinks bool, parents map[string]bool, entries *[]workspaceEntry) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if parents[real] {
+		return nil
+	}
+	parents[real] = true
+	defer delete(parents, real)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		p := path.Join(rel, info.Name())
+		full := filepath.Join(dir, info.Name())
+
+		isDir := info.IsDir()
+		if followLinks && info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(full); err == nil && target.IsDir() {
+				isDir = true
+			}
+		}
+
+		*entries = append(*entries, workspaceEntry{p, isDir})
+		if isDir {
+			if err := walkDirectory(full, p, followLinks, parents, entries); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package codebuild
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/piotrkubisa/localcb/ci"
+)
+
+// Types of the local caches managed by the localcb
+const (
+	// CachePaths keeps files matched by `cache.paths` of the buildspec
+	CachePaths = "paths"
+	// CacheDockerLayer keeps images and layers of the Docker daemon which is
+	// run inside the build container
+	CacheDockerLayer = "docker-layer"
+	// CacheSource keeps a git checkout of the source
+	CacheSource = "source"
+)
+
+// Local cache modes of the CodeBuild project
+const (
+	CacheModeDockerLayer = "LOCAL_DOCKER_LAYER_CACHE"
+	CacheModeSource      = "LOCAL_SOURCE_CACHE"
+	CacheModeCustom      = "LOCAL_CUSTOM_CACHE"
+)
+
+const (
+	cacheLabelProject = "localcb.project"
+	cacheLabelType    = "localcb.cache"
+
+	// guestCacheDirectory is where the cache of `cache.paths` is mounted
+	guestCacheDirectory = guestStateDirectory + "/cache"
+	// guestDockerDirectory is the data root of the Docker daemon
+	guestDockerDirectory = "/var/lib/docker"
+)
+
+// LocalCache keeps files of the project between the builds, either in a named
+// Docker volume (default) or in a directory on the host.
+type LocalCache struct {
+	Project string
+	Type    string
+
+	// HostDir is an absolute path to the directory on the host where caches
+	// of all projects are kept (empty - Docker volumes are used instead)
+	HostDir string
+}
+
+// NewLocalCache creates a LocalCache of the given type for the project
+func NewLocalCache(project, cacheType, hostDir string) (LocalCache, error) {
+	lc := LocalCache{Project: project, Type: cacheType}
+	if len(hostDir) > 0 {
+		abs, err := filepath.Abs(hostDir)
+		if err != nil {
+			return lc, err
+		}
+		lc.HostDir = abs
+	}
+
+	return lc, nil
+}
+
+// stateDir returns a directory of the localcb in the cache directory of the user
+func stateDir() string {
+	userCache, err := os.UserCacheDir()
+	if err != nil {
+		userCache = os.TempDir()
+	}
+
+	return filepath.Join(userCache, "localcb")
+}
+
+// defaultCacheDir returns a directory on the host where the localcb keeps
+// caches which cannot be kept in the Docker volumes.
+func defaultCacheDir() string {
+	return filepath.Join(stateDir(), "caches")
+}
+
+// LockCaches locks all caches, the returned function releases them
+func LockCaches(caches []LocalCache) (func(), error) {
+	unlocks := []func(){}
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	for _, lc := range caches {
+		unlock, err := lc.Lock()
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+
+	return unlockAll, nil
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// cacheKey turns the project name into a valid volume or directory name
+func cacheKey(project string) string {
+	return unsafeNameChars.ReplaceAllString(project, "_")
+}
+
+// Location returns a name of the volume or a path to the directory on the host
+func (lc LocalCache) Location() string {
+	if len(lc.HostDir) > 0 {
+		return filepath.Join(lc.HostDir, cacheKey(lc.Project), lc.Type)
+	}
+
+	return "localcb-" + cacheKey(lc.Project) + "-" + lc.Type
+}
+
+// Bind returns a volume definition (as in docker cli) which mounts the cache
+// at the guestPath.
+func (lc LocalCache) Bind(guestPath string) string {
+	return lc.Location() + ":" + guestPath
+}
+
+func (lc LocalCache) labels() map[string]string {
+	return map[string]string{
+		cacheLabelProject: lc.Project,
+		cacheLabelType:    lc.Type,
+	}
+}
+
+// Prepare creates the volume or the directory on the host, if it does not
+// exist yet.
+func (lc LocalCache) Prepare(p *ci.Pipeline) error {
+	if len(lc.HostDir) > 0 {
+		return os.MkdirAll(lc.Location(), 0755)
+	}
+
+	return p.VolumeEnsure(lc.Location(), lc.labels())
+}
+
+// PrepareCommand returns a shell command which does the same as Prepare
+func (lc LocalCache) PrepareCommand() string {
+	if len(lc.HostDir) > 0 {
+		return "mkdir -p " + shellQuote(lc.Location())
+	}
+
+	return fmt.Sprintf("docker volume create --label %s=%s --label %s=%s %s",
+		cacheLabelProject, shellQuote(lc.Project), cacheLabelType, lc.Type, lc.Location())
+}
+
+// Lock acquires an exclusive lock of the cache, so concurrent builds of the
+// same project wait for each other instead of corrupting the cache. The
+// returned function releases the lock.
+func (lc LocalCache) Lock() (func(), error) {
+	dir := filepath.Join(lc.HostDir, cacheKey(lc.Project))
+	if len(lc.HostDir) == 0 {
+		// Volumes are not accessible from the host, so their locks are kept
+		// in the cache directory of the user
+		dir = filepath.Join(stateDir(), "locks")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	name := lc.Type + ".lock"
+	if len(lc.HostDir) == 0 {
+		name = lc.Location() + ".lock"
+	}
+	return lockFile(filepath.Join(dir, name))
+}
+
+// Clear removes the volume or the directory on the host with all cached files
+func (lc LocalCache) Clear(p *ci.Pipeline) error {
+	unlock, err := lc.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if len(lc.HostDir) > 0 {
+		return os.RemoveAll(lc.Location())
+	}
+
+	return p.VolumeRemove(lc.Location())
+}
+
+// CacheEntry describes an existing LocalCache
+type CacheEntry struct {
+	LocalCache
+
+	// Size of the cached files in bytes (-1 if unknown)
+	Size int64
+}
+
+// FindVolumeCaches lists caches kept in the Docker volumes which belong to
+// the project and have the given type (empty - any project or any type).
+func FindVolumeCaches(p *ci.Pipeline, project, cacheType string) ([]CacheEntry, error) {
+	volumes, err := p.VolumeList(map[string]string{
+		cacheLabelProject: project,
+		cacheLabelType:    cacheType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sizes, err := p.VolumeSizes()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []CacheEntry{}
+	for _, v := range volumes {
+		lc := LocalCache{Project: v.Labels[cacheLabelProject], Type: v.Labels[cacheLabelType]}
+		if lc.Location() != v.Name {
+			// Volume has been labelled by something else than the localcb
+			continue
+		}
+
+		size, ok := sizes[v.Name]
+		if !ok {
+			size = -1
+		}
+		entries = append(entries, CacheEntry{lc, size})
+	}
+	return entries, nil
+}
+
+// FindHostCaches lists caches kept in the hostDir which belong to the project
+// and have the given type (empty - any project or any type).
+func FindHostCaches(hostDir, project, cacheType string) ([]CacheEntry, error) {
+	abs, err := filepath.Abs(hostDir)
+	if err != nil {
+		return nil, err
+	}
+
+	projects, err := ioutil.ReadDir(abs)
+	if os.IsNotExist(err) {
+		return []CacheEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []CacheEntry{}
+	for _, pd := range projects {
+		if !pd.IsDir() || (len(project) > 0 && pd.Name() != cacheKey(project)) {
+			continue
+		}
+
+		types, err := ioutil.ReadDir(filepath.Join(abs, pd.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, td := range types {
+			if !td.IsDir() || (len(cacheType) > 0 && td.Name() != cacheType) {
+				continue
+			}
+
+			lc := LocalCache{Project: pd.Name(), Type: td.Name(), HostDir: abs}
+			entries = append(entries, CacheEntry{lc, directorySize(lc.Location())})
+		}
+	}
+	return entries, nil
+}
+
+// directorySize sums sizes of all files inside the directory (-1 if unknown)
+func directorySize(dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return -1
+	}
+
+	return size
+}
+
+// CachedDirectory is a directory which holds files matched by a pattern from
+// `cache.paths`, so it is restored before and saved after the build.
+type CachedDirectory struct {
+	// Path in the container, relative paths are relative to the source
+	// directory and paths starting with ~/ to the home directory
+	Path string
+	// Key is a location of the cached copy, relative to the cache root
+	Key string
+}
+
+// Directories returns directories which hold files matched by the patterns of
+// `cache.paths`, i.e. /root/.m2 for /root/.m2/**/*.
+func (c Cache) Directories() ([]CachedDirectory, error) {
+	dirs := []CachedDirectory{}
+	seen := map[string]bool{}
+	for _, pattern := range c.Paths {
+		dir, err := cachedDirectory(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[dir.Key] {
+			seen[dir.Key] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+func cachedDirectory(pattern string) (CachedDirectory, error) {
+	pattern = path.Clean(pattern)
+	root := []string{}
+	for _, segment := range strings.Split(pattern, "/") {
+		if strings.ContainsAny(segment, "*?[{") {
+			break
+		}
+		root = append(root, segment)
+	}
+
+	p := strings.Join(root, "/")
+	if p == "" && strings.HasPrefix(pattern, "/") {
+		p = "/"
+	}
+	p = path.Clean(p)
+
+	switch {
+	case p == "/" || p == "~":
+		return CachedDirectory{}, fmt.Errorf("cache path %s must point to a directory below / or ~", pattern)
+	case strings.HasPrefix(p, "/"):
+		return CachedDirectory{Path: p, Key: path.Join("abs", p)}, nil
+	case strings.HasPrefix(p, "~/"):
+		return CachedDirectory{Path: p, Key: path.Join("home", p[2:])}, nil
+	case p == ".":
+		return CachedDirectory{Path: p, Key: "src"}, nil
+	case p == ".." || strings.HasPrefix(p, "../"):
+		return CachedDirectory{}, fmt.Errorf("cache path %s must not point outside of the source directory", pattern)
+	}
+
+	return CachedDirectory{Path: p, Key: path.Join("src", p)}, nil
+}
+
+// shellPath returns the path of the directory as a shell word
+func (d CachedDirectory) shellPath() string {
+	switch {
+	case strings.HasPrefix(d.Path, "/"):
+		return shellQuote(d.Path)
+	case strings.HasPrefix(d.Path, "~/"):
+		return `"$HOME"/` + shellQuote(d.Path[2:])
+	}
+
+	return `"$localcb_src_dir"/` + shellQuote(d.Path)
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package codebuild
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive advisory lock of the file, waiting for other
+// processes to release it. The lock is released by the returned function or,
+// when the localcb is killed, by the operating system.
+func lockFile(location string) (func(), error) {
+	f, err := os.OpenFile(location, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		log.Printf("Waiting for another build to release %s", location)
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
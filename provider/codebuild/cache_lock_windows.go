@@ -0,0 +1,30 @@
+package codebuild
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// lockFile acquires an exclusive lock by creating the file, waiting for other
+// processes to remove it. The file is removed by the returned function, so it
+// has to be removed by hand when the localcb has been killed.
+func lockFile(location string) (func(), error) {
+	waiting := false
+	for {
+		f, err := os.OpenFile(location, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(location) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if !waiting {
+			log.Printf("Waiting for another build to release %s (remove the file if no other build is running)", location)
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+}
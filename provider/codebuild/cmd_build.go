@@ -23,6 +23,125 @@ cd {{.ImagePath}}
 docker build -t {{.DockerImage}} .
 `
 
+// unsupportedImages lists curated images which are kept in the "Unsupported
+// Images" directory of the aws-codebuild-docker-images repository.
+var unsupportedImages = []string{
+	"android-java-8:24.4.1",
+	"android-java-8:26.1.1",
+	"docker:1.12.1",
+	"docker:17.09.0",
+	"docker:18.09.0",
+	"dot-net:core-1",
+	"dot-net:core-2.1",
+	"dot-net:core-2",
+	"golang:1.10",
+	"golang:1.11",
+	"golang:1.5.4",
+	"golang:1.6.3",
+	"golang:1.7.3",
+	"java:openjdk-11",
+	"java:openjdk-6",
+	"java:openjdk-7",
+	"java:openjdk-8",
+	"java:openjdk-9",
+	"nodejs:10.1.0",
+	"nodejs:10.14.1",
+	"nodejs:4.3.2",
+	"nodejs:4.4.7",
+	"nodejs:5.12.0",
+	"nodejs:6.3.1",
+	"nodejs:7.0.0",
+	"nodejs:8.11.0",
+	"php:5.6",
+	"php:7.0",
+	"php:7.1",
+	"python:2.7.12",
+	"python:3.3.6",
+	"python:3.4.5",
+	"python:3.5.2",
+	"python:3.6.5",
+	"python:3.7.1",
+	"ruby:2.1.10",
+	"ruby:2.2.5",
+	"ruby:2.3.1",
+	"ruby:2.5.1",
+	"ruby:2.5.3",
+	"ubuntu-base:14.04",
+}
+
+// standardImages maps curated standard images to their location in the
+// aws-codebuild-docker-images repository.
+var standardImages = map[string]string{
+	"standard:2.0":                     "ubuntu/standard/2.0",
+	"standard:3.0":                     "ubuntu/standard/3.0",
+	"amazonlinux2-x86_64-standard:1.0": "al2/x86_64/standard/1.0",
+	"amazonlinux2-x86_64-standard:2.0": "al2/x86_64/standard/2.0",
+}
+
+// standardRuntimes lists runtimes (and their versions, from the oldest one)
+// which can be selected with `runtime-versions` in the standard images.
+var standardRuntimes = map[string]map[string][]string{
+	"standard:2.0": {
+		"android": {"28", "29"},
+		"docker":  {"18"},
+		"dotnet":  {"2.2", "3.0"},
+		"golang":  {"1.12", "1.13"},
+		"java":    {"openjdk8", "openjdk11"},
+		"nodejs":  {"8", "10", "12"},
+		"php":     {"7.3"},
+		"python":  {"3.7", "3.8"},
+		"ruby":    {"2.6"},
+	},
+	"standard:3.0": {
+		"android": {"28", "29"},
+		"docker":  {"18", "19"},
+		"dotnet":  {"3.1"},
+		"golang":  {"1.12", "1.13", "1.14"},
+		"java":    {"corretto8", "corretto11", "openjdk8", "openjdk11"},
+		"nodejs":  {"10", "12"},
+		"php":     {"7.3", "7.4"},
+		"python":  {"3.7", "3.8"},
+		"ruby":    {"2.6", "2.7"},
+	},
+	"amazonlinux2-x86_64-standard:1.0": {
+		"android": {"28"},
+		"docker":  {"18"},
+		"dotnet":  {"2.2"},
+		"golang":  {"1.12"},
+		"java":    {"corretto8", "corretto11", "openjdk8", "openjdk11"},
+		"nodejs":  {"8", "10"},
+		"php":     {"7.3"},
+		"python":  {"3.7"},
+		"ruby":    {"2.6"},
+	},
+	"amazonlinux2-x86_64-standard:2.0": {
+		"docker": {"18", "19"},
+		"dotnet": {"3.1"},
+		"golang": {"1.13"},
+		"java":   {"corretto8", "corretto11"},
+		"nodejs": {"10", "12"},
+		"php":    {"7.3", "7.4"},
+		"python": {"3.8"},
+		"ruby":   {"2.6"},
+	},
+}
+
+// curatedImagePath returns location of the image in the
+// aws-codebuild-docker-images repository.
+func curatedImagePath(shortImage string) (string, bool) {
+	if path, ok := standardImages[shortImage]; ok {
+		return path, true
+	}
+
+	for _, i := range unsupportedImages {
+		if i == shortImage {
+			return "ubuntu/Unsupported\\ Images/" + strings.Replace(shortImage, ":", "/", 1), true
+		}
+	}
+
+	return "", false
+}
+
 // BuildCommand registers a cli.Command
 func BuildCommand() cli.Command {
 	return cli.Command{
@@ -39,65 +158,12 @@ func buildCommand(c *cli.Context) error {
 		return fmt.Errorf("Provide name of the docker image, i.e. aws/codebuild/golang:1.10 or golang:1.10")
 	}
 
-	var (
-		knownImages = []string{
-			"android-java-8:24.4.1",
-			"android-java-8:26.1.1",
-			"docker:1.12.1",
-			"docker:17.09.0",
-			"docker:18.09.0",
-			"dot-net:core-1",
-			"dot-net:core-2.1",
-			"dot-net:core-2",
-			"golang:1.10",
-			"golang:1.11",
-			"golang:1.5.4",
-			"golang:1.6.3",
-			"golang:1.7.3",
-			"java:openjdk-11",
-			"java:openjdk-6",
-			"java:openjdk-7",
-			"java:openjdk-8",
-			"java:openjdk-9",
-			"nodejs:10.1.0",
-			"nodejs:10.14.1",
-			"nodejs:4.3.2",
-			"nodejs:4.4.7",
-			"nodejs:5.12.0",
-			"nodejs:6.3.1",
-			"nodejs:7.0.0",
-			"nodejs:8.11.0",
-			"php:5.6",
-			"php:7.0",
-			"php:7.1",
-			"python:2.7.12",
-			"python:3.3.6",
-			"python:3.4.5",
-			"python:3.5.2",
-			"python:3.6.5",
-			"python:3.7.1",
-			"ruby:2.1.10",
-			"ruby:2.2.5",
-			"ruby:2.3.1",
-			"ruby:2.5.1",
-			"ruby:2.5.3",
-			"ubuntu-base:14.04",
-		}
-
-		imagePath   string
-		dockerImage string
-	)
 	shortImage := strings.TrimPrefix(image, "aws/codebuild/")
-	for _, i := range knownImages {
-		if i == shortImage {
-			imagePath = "ubuntu/Unsupported\\ Images/" + strings.Replace(shortImage, ":", "/", 1)
-			dockerImage = "aws/codebuild/" + shortImage
-			break
-		}
-	}
-	if dockerImage == "" {
+	imagePath, ok := curatedImagePath(shortImage)
+	if !ok {
 		return fmt.Errorf("Unknown image name (%s), you might need to build it manually", image)
 	}
+	dockerImage := "aws/codebuild/" + shortImage
 
 	tpl, err := template.New("script").Parse(buildTemplate)
 	if err != nil {
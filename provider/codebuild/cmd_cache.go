@@ -0,0 +1,142 @@
+package codebuild
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/piotrkubisa/localcb/ci"
+	"github.com/piotrkubisa/localcb/cmd"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var cacheFlags = struct {
+	ProjectName cmd.FlagPair
+	CacheDir    cmd.FlagPair
+	Type        cmd.FlagPair
+}{
+	ProjectName: cmd.NewFlagPair("project-name", "p"),
+	CacheDir:    cmd.NewFlagPair("cache-dir", ""),
+	Type:        cmd.NewFlagPair("type", "t"),
+}
+
+// CacheCommand registers a cli.Command
+func CacheCommand() cli.Command {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:  cacheFlags.ProjectName.Join(),
+			Usage: "Optional. Name of the project. By default caches of all projects are used.",
+		},
+		cli.StringFlag{
+			Name:  cacheFlags.CacheDir.Join(),
+			Usage: "Optional. Location to the directory on the host with the caches (as in the run command). By default Docker volumes are used.",
+		},
+		cli.StringFlag{
+			Name:  cacheFlags.Type.Join(),
+			Usage: "Optional. Type of the cache: " + CachePaths + ", " + CacheDockerLayer + " or " + CacheSource + ". By default caches of all types are used.",
+		},
+	}
+
+	return cli.Command{
+		Name:  "cache",
+		Usage: "Manages caches kept by localcb between the builds",
+		Subcommands: []cli.Command{
+			{
+				Name:   "inspect",
+				Usage:  "Lists caches with their size and location",
+				Flags:  flags,
+				Action: cacheInspectCommand,
+			},
+			{
+				Name:   "clear",
+				Usage:  "Removes caches, so the next build starts from scratch",
+				Flags:  flags,
+				Action: cacheClearCommand,
+			},
+		},
+	}
+}
+
+// findCaches lists caches selected by the flags. The pipeline is nil when
+// caches are kept on the host, so Docker is not required. Caches kept in the
+// Docker volumes are listed along with caches kept in the default directory.
+func findCaches(c *cli.Context) (*ci.Pipeline, []CacheEntry, error) {
+	project := c.String(cacheFlags.ProjectName.Long)
+	cacheType := c.String(cacheFlags.Type.Long)
+
+	if cacheDir := c.String(cacheFlags.CacheDir.Long); cacheDir != "" {
+		entries, err := FindHostCaches(cacheDir, project, cacheType)
+		return nil, entries, err
+	}
+
+	pipeline, err := ci.NewPipeline()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "localcb: ci.NewPipeline")
+	}
+
+	entries, err := FindVolumeCaches(pipeline, project, cacheType)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "localcb: FindVolumeCaches")
+	}
+
+	hostEntries, err := FindHostCaches(defaultCacheDir(), project, cacheType)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "localcb: FindHostCaches")
+	}
+	return pipeline, append(entries, hostEntries...), nil
+}
+
+func cacheInspectCommand(c *cli.Context) error {
+	_, entries, err := findCaches(c)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No caches found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tTYPE\tSIZE\tLOCATION")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Project, e.Type, humanSize(e.Size), e.Location())
+	}
+	return w.Flush()
+}
+
+func cacheClearCommand(c *cli.Context) error {
+	pipeline, entries, err := findCaches(c)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := e.Clear(pipeline); err != nil {
+			return errors.Wrapf(err, "localcb: cannot clear %s cache of %s", e.Type, e.Project)
+		}
+		fmt.Printf("Removed %s cache of %s (%s)\n", e.Type, e.Project, e.Location())
+	}
+
+	return nil
+}
+
+// humanSize formats size in bytes using binary units
+func humanSize(size int64) string {
+	if size < 0 {
+		return "unknown"
+	}
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value, i := float64(size), 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%d %s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
@@ -1,11 +1,15 @@
 package codebuild
 
 import (
+	"bytes"
+	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/awslabs/goformation/cloudformation"
+	"github.com/piotrkubisa/localcb/ci"
 	"github.com/piotrkubisa/localcb/cmd"
 	"github.com/urfave/cli"
 )
@@ -27,6 +31,23 @@ var runFlags = struct {
 	DockerVolumes    cmd.FlagPair
 	DockerNetwork    cmd.FlagPair
 	ForcePullImage   cmd.FlagPair
+	ParametersFile   cmd.FlagPair
+	SecretsFile      cmd.FlagPair
+	ConfigFile       cmd.FlagPair
+	ExportedVarsFile cmd.FlagPair
+	ReportsFile      cmd.FlagPair
+	ArtifactsDir     cmd.FlagPair
+	ArtifactsPackage cmd.FlagPair
+	ArtifactsIDs     cmd.FlagPair
+	CacheDir         cmd.FlagPair
+	CacheModes       cmd.FlagPair
+	Template         cmd.FlagPair
+	TemplateResource cmd.FlagPair
+	Batch            cmd.FlagPair
+	BatchConcurrency cmd.FlagPair
+	BatchBuilds      cmd.FlagPair
+	Exec             cmd.FlagPair
+	CommandsFile     cmd.FlagPair
 }{
 	ProjectName:      cmd.NewFlagPair("project-name", "p"),
 	LogFile:          cmd.NewFlagPair("log-file", "l"),
@@ -39,6 +60,23 @@ var runFlags = struct {
 	DockerVolumes:    cmd.NewFlagPair("volume", "v"),
 	DockerNetwork:    cmd.NewFlagPair("network", "net"),
 	ForcePullImage:   cmd.NewFlagPair("force-pull-image", "u"),
+	ParametersFile:   cmd.NewFlagPair("parameters-file", ""),
+	SecretsFile:      cmd.NewFlagPair("secrets-file", ""),
+	ConfigFile:       cmd.NewFlagPair("config", ""),
+	ExportedVarsFile: cmd.NewFlagPair("exported-variables-file", ""),
+	ReportsFile:      cmd.NewFlagPair("reports-file", ""),
+	ArtifactsDir:     cmd.NewFlagPair("artifacts-dir", "a"),
+	ArtifactsPackage: cmd.NewFlagPair("artifacts-packaging", ""),
+	ArtifactsIDs:     cmd.NewFlagPair("artifacts-identifier", ""),
+	CacheDir:         cmd.NewFlagPair("cache-dir", ""),
+	CacheModes:       cmd.NewFlagPair("cache-mode", ""),
+	Template:         cmd.NewFlagPair("template", ""),
+	TemplateResource: cmd.NewFlagPair("template-resource", ""),
+	Batch:            cmd.NewFlagPair("batch", ""),
+	BatchConcurrency: cmd.NewFlagPair("batch-concurrency", ""),
+	BatchBuilds:      cmd.NewFlagPair("batch-build", ""),
+	Exec:             cmd.NewFlagPair("exec", ""),
+	CommandsFile:     cmd.NewFlagPair("commands-file", ""),
 }
 
 // RunCommand registers a cli.Command
@@ -94,6 +132,75 @@ func RunCommand() cli.Command {
 				Name:  runFlags.ForcePullImage.Join(),
 				Usage: "Optional. Does docker client should try to pull new version of container image even if it is already in local registry (to try update it)?",
 			},
+			cli.StringFlag{
+				Name:  runFlags.ParametersFile.Join(),
+				Usage: "Optional. Location to the YAML/JSON file with values of parameters referenced in env.parameter-store. By default localcb-parameters.yml from --basedir is used.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.SecretsFile.Join(),
+				Usage: "Optional. Location to the YAML/JSON file with secrets referenced in env.secrets-manager. By default localcb-secrets.yml from --basedir is used.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.ConfigFile.Join(),
+				Usage: "Optional. Location to the YAML/JSON file with localcb settings, i.e. code coverage thresholds of the report groups. By default localcb.yml from --basedir is used.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.ExportedVarsFile.Join(),
+				Usage: "Optional. Location to the JSON file where values of env.exported-variables are saved after the build. By default localcb-exported-variables.json in --basedir is used.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.ReportsFile.Join(),
+				Usage: "Optional. Location to the JSON file where test cases collected from the reports section are saved after the build. By default localcb-reports.json in --basedir is used.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.ArtifactsDir.Join(),
+				Usage: "Optional. Location to the directory where files defined in the artifacts section are saved after a successful build. By default artifacts are not produced.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.ArtifactsPackage.Join(),
+				Value: PackagingNone,
+				Usage: "Optional. Packaging of the artifacts: ZIP or NONE (files are copied to a directory).",
+			},
+			cli.StringSliceFlag{
+				Name:  runFlags.ArtifactsIDs.Join(),
+				Usage: "Optional. Identifier of the secondary artifact which should be collected (can be repeated). By default all secondary artifacts are collected.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.CacheDir.Join(),
+				Usage: "Optional. Location to the directory on the host where cached paths are kept between the builds. By default each project gets its own Docker volume.",
+			},
+			cli.StringSliceFlag{
+				Name:  runFlags.CacheModes.Join(),
+				Usage: "Optional. Mode of the LOCAL cache of the project (can be repeated): LOCAL_DOCKER_LAYER_CACHE, LOCAL_SOURCE_CACHE or LOCAL_CUSTOM_CACHE. Overrides modes from the --template.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.Template.Join(),
+				Usage: "Optional. Location to the CloudFormation template (YAML/JSON) with the AWS::CodeBuild::Project, which cache configuration is used by the build.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.TemplateResource.Join(),
+				Usage: "Optional. Logical ID of the AWS::CodeBuild::Project resource in the --template. Required only if the template defines many projects.",
+			},
+			cli.BoolFlag{
+				Name:  runFlags.Batch.Join(),
+				Usage: "Optional. Runs builds defined in the batch section of the buildspec instead of a single build.",
+			},
+			cli.IntFlag{
+				Name:  runFlags.BatchConcurrency.Join(),
+				Usage: "Optional. Maximum number of the batch builds which are run at the same time. By default as many as CPUs.",
+			},
+			cli.StringSliceFlag{
+				Name:  runFlags.BatchBuilds.Join(),
+				Usage: "Optional. Identifier of the batch build which should be run (can be repeated), i.e. build2 of the build matrix. By default all builds of the batch are run.",
+			},
+			cli.BoolFlag{
+				Name:  runFlags.Exec.Join(),
+				Usage: "Optional. Runs each command separately with docker exec in the same container, recording its exit code, time and output.",
+			},
+			cli.StringFlag{
+				Name:  runFlags.CommandsFile.Join(),
+				Usage: "Optional. Location to the JSON file where results of the commands run with --exec are saved after the build. By default localcb-commands.json in --basedir is used.",
+			},
 		},
 		Action: runCommand,
 	}
@@ -128,49 +235,342 @@ func runCommand(c *cli.Context) error {
 			BuildSpec: c.String(runFlags.BuildspecFile.Long),
 		},
 		Artifacts: &cloudformation.AWSCodeBuildProject_Artifacts{
-			// TODO: It would be nice to produce an artifact as a result
 			Type: "NO_ARTIFACTS",
 		},
 	}
 
+	// Directory on the host plays a role of the S3 bucket for artifacts
+	if artifactsDir := c.String(runFlags.ArtifactsDir.Long); artifactsDir != "" {
+		project.Artifacts = &cloudformation.AWSCodeBuildProject_Artifacts{
+			Type:      "S3",
+			Location:  artifactsDir,
+			Name:      project.Name,
+			Packaging: strings.ToUpper(c.String(runFlags.ArtifactsPackage.Long)),
+		}
+	}
+
 	cb, err := NewCodeBuild(project)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	cb.PhasesAsStages()
+	if c.Bool(runFlags.Batch.Long) {
+		return runBatch(c, cb, baseDir)
+	}
 
-	err = cb.StagesAsScript(baseDir, scriptFile)
+	cfg, unlockCaches, err := prepareBuild(c, cb, baseDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer unlockCaches()
+
+	// Bail-out if running in dry-run mode
+	if c.Bool(runFlags.DryRun.Long) == true {
+		cb.DryRun(cfg)
+		return nil
+	}
+
+	return cb.RunInContainer(cfg)
+}
+
+// prepareBuild configures caches, writes the localcb.sh script and resolves
+// everything the container needs. Files of the builds in the batch are named
+// after their identifiers. Caches stay locked (and copies of the source kept)
+// until the returned function is called.
+func prepareBuild(c *cli.Context, cb *CodeBuild, baseDir string) (cfg RunConfiguration, unlockCaches func(), err error) {
+	// Cache configuration comes from the template, unless modes are given
+	var cache *cloudformation.AWSCodeBuildProject_ProjectCache
+	cacheModes := c.StringSlice(runFlags.CacheModes.Long)
+	if template := c.String(runFlags.Template.Long); template != "" {
+		var templateModes []string
+		cache, templateModes, err = LoadProjectCache(template, c.String(runFlags.TemplateResource.Long))
+		if err != nil {
+			return cfg, nil, err
+		}
+		if len(cacheModes) == 0 {
+			cacheModes = templateModes
+		}
+	}
+
+	err = cb.SetCache(cache, cacheModes)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	caches, err := cb.LocalCaches(c.String(runFlags.CacheDir.Long))
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	unlock, err := LockCaches(caches)
+	if err != nil {
+		return cfg, nil, err
+	}
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+
+	// Source cache replaces the source directory with a clean checkout
+	for _, lc := range caches {
+		if lc.Type != CacheSource {
+			continue
+		}
+		if err = cb.CheckoutSource(lc); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	cb.ResolveSourceVersion()
+
+	// Builds of the batch run in parallel on their own copies of the source,
+	// which are removed along with unlocking the caches
+	cb.GeneratedPaths = []string{c.String(runFlags.ArtifactsDir.Long), c.String(runFlags.CacheDir.Long)}
+	if len(cb.BatchIdentifier) > 0 && c.Bool(runFlags.DryRun.Long) == false {
+		removeCopy, err := cb.CopySource()
+		if err != nil {
+			return cfg, nil, err
+		}
+		unlockCaches := unlock
+		unlock = func() {
+			removeCopy()
+			unlockCaches()
+		}
+	}
+
+	// Caches are unlocked and the copy of the source is removed also when
+	// the build is interrupted
+	releaseInterrupt := ci.OnInterrupt(unlock)
+	cleanUp := unlock
+	unlock = func() {
+		releaseInterrupt()
+		cleanUp()
+	}
+	sourceDir := cb.Project.Source.Location
+	if strings.HasSuffix(sourceDir, "/") == false {
+		sourceDir += "/"
+	}
+
+	if cb.Project.Artifacts.Type != "NO_ARTIFACTS" {
+		err = cb.SelectSecondaryArtifacts(c.StringSlice(runFlags.ArtifactsIDs.Long))
+		if err != nil {
+			return cfg, nil, err
+		}
+	} else if len(c.StringSlice(runFlags.ArtifactsIDs.Long)) > 0 {
+		err = fmt.Errorf("Please specify value for --%s flag, artifacts are not produced without it", runFlags.ArtifactsDir.Long)
+		return cfg, nil, err
+	}
+
+	err = cb.PhasesAsStages()
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	script := batchFileName(scriptFile, cb.BatchIdentifier)
+	err = cb.StagesAsScript(sourceDir, script)
+	if err != nil {
+		return cfg, nil, err
+	}
 
 	volumes, err := cb.Volumes(c.StringSlice(runFlags.DockerVolumes.Long))
 	if err != nil {
-		log.Fatal(err)
+		return cfg, nil, err
 	}
+	volumes = append(volumes, cb.CacheVolumes(caches)...)
 
-	cfg := RunConfiguration{
-		LogFile:          c.String(runFlags.LogFile.Long),
-		EnvVariables:     cb.EnvVariables(c.StringSlice(runFlags.Env.Long)),
-		WorkingDirectory: cb.WorkingDirectory(c.String(runFlags.DockerWorkingDir.Long)),
-		Volume:           volumes,
-		ForcePullImage:   c.Bool(runFlags.ForcePullImage.Long),
-		NetworkName:      c.String(runFlags.DockerNetwork.Long),
-		ContainerName:    containerName,
+	cb.Parameters, err = LoadParameterStore(c.String(runFlags.ParametersFile.Long), baseDir)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	cb.Secrets, err = LoadSecretsManager(c.String(runFlags.SecretsFile.Long), baseDir)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	cb.Config, err = LoadConfig(c.String(runFlags.ConfigFile.Long), baseDir)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	envVariables, err := cb.EnvVariables(c.StringSlice(runFlags.Env.Long))
+	if err != nil {
+		return cfg, nil, err
 	}
 
+	exportedVarsFile := c.String(runFlags.ExportedVarsFile.Long)
+	if exportedVarsFile == "" {
+		exportedVarsFile = baseDir + "localcb-exported-variables.json"
+	}
+
+	reportsFile := c.String(runFlags.ReportsFile.Long)
+	if reportsFile == "" {
+		reportsFile = baseDir + "localcb-reports.json"
+	}
+
+	commandsFile := c.String(runFlags.CommandsFile.Long)
+	if commandsFile == "" {
+		commandsFile = baseDir + "localcb-commands.json"
+	}
+
+	cfg = RunConfiguration{
+		ScriptFile:            script,
+		LogFile:               batchFileName(c.String(runFlags.LogFile.Long), cb.BatchIdentifier),
+		ExportedVariablesFile: batchFileName(exportedVarsFile, cb.BatchIdentifier),
+		ReportsFile:           batchFileName(reportsFile, cb.BatchIdentifier),
+		Exec:                  c.Bool(runFlags.Exec.Long),
+		CommandsFile:          batchFileName(commandsFile, cb.BatchIdentifier),
+		EnvVariables:          envVariables,
+		SecretVariables:       cb.SecretVariables(),
+		WorkingDirectory:      cb.WorkingDirectory(c.String(runFlags.DockerWorkingDir.Long)),
+		Volume:                volumes,
+		ForcePullImage:        c.Bool(runFlags.ForcePullImage.Long),
+		NetworkName:           c.String(runFlags.DockerNetwork.Long),
+		Caches:                caches,
+		ContainerName:         containerName,
+	}
+
+	cb.GeneratedPaths = append(cb.GeneratedPaths,
+		sourceDir+script,
+		cfg.LogFile,
+		cfg.ExportedVariablesFile,
+		cfg.ReportsFile,
+		cfg.CommandsFile,
+	)
+
 	err = cb.Validate(cfg)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	return cfg, unlock, nil
+}
+
+// runBatch runs builds defined in the batch section of the buildspec. Each
+// build gets its own script, logs and results, named after its identifier.
+func runBatch(c *cli.Context, cb *CodeBuild, baseDir string) error {
+	builds, err := cb.Definition.Batch.Builds()
 	if err != nil {
 		log.Fatal(err)
-		return err
 	}
 
-	// Bail-out if running in dry-run mode
+	builds, err = SelectBuilds(builds, c.StringSlice(runFlags.BatchBuilds.Long))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Buildspecs of all builds are parsed before any of them starts
+	runtimes := map[string]*CodeBuild{}
+	reports := map[string]ReportGroup{}
+	for _, bb := range builds {
+		runtimes[bb.Identifier], err = NewBatchCodeBuild(cb.Project, bb)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for name, rg := range runtimes[bb.Identifier].Definition.Reports {
+			if _, ok := reports[name]; !ok {
+				reports[name] = rg
+			}
+		}
+	}
+
+	// Coverage thresholds may refer to report groups of any of the builds
+	config, err := LoadConfig(c.String(runFlags.ConfigFile.Long), baseDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := config.Validate(reports); err != nil {
+		log.Fatal(err)
+	}
+
+	// Bail-out if running in dry-run mode, builds are printed in the order
+	// of their dependencies
 	if c.Bool(runFlags.DryRun.Long) == true {
-		cb.DryRun(cfg)
+		graph, err := batchGraph(builds)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		byID := map[string]BatchBuild{}
+		for _, bb := range builds {
+			byID[bb.Identifier] = bb
+		}
+		for _, id := range graph.Order() {
+			cfg, unlockCaches, err := prepareBuild(c, runtimes[id], baseDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("# %s\n", byID[id].Name())
+			if deps := byID[id].DependOn; len(deps) > 0 {
+				fmt.Printf("# depends on: %s\n", strings.Join(deps, ", "))
+			}
+			runtimes[id].DryRun(cfg)
+			unlockCaches()
+		}
 		return nil
 	}
 
-	return cb.RunInContainer(cfg)
+	stdout, stderr := ci.NewSharedOutput(os.Stdout), ci.NewSharedOutput(os.Stderr)
+	summary, err := RunBatch(builds, c.Int(runFlags.BatchConcurrency.Long), cb.Definition.Batch.FastFail, func(bb BatchBuild) (RunSummary, error) {
+		return runBatchBuild(c, runtimes[bb.Identifier], baseDir, stdout, stderr)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Reports of the shards are merged and saved as reports of the batch
+	if cb.Definition.Batch.BuildFanout != nil {
+		summary.MergeReports(config)
+
+		reportsFile := c.String(runFlags.ReportsFile.Long)
+		if reportsFile == "" {
+			reportsFile = baseDir + "localcb-reports.json"
+		}
+		if err := SaveReports(reportsFile, summary.Reports); err != nil {
+			log.Fatal(err)
+		}
+	}
+	summary.Print(os.Stdout)
+
+	return summary.Err()
+}
+
+// runBatchBuild runs a single build of the batch. Its logs are written to its
+// own log file or, with each line prefixed by the identifier, to the output
+// shared with other builds.
+func runBatchBuild(c *cli.Context, cb *CodeBuild, baseDir string, stdout, stderr *ci.SharedOutput) (RunSummary, error) {
+	cfg, unlockCaches, err := prepareBuild(c, cb, baseDir)
+	if err != nil {
+		return RunSummary{ExitCode: -1}, err
+	}
+	defer unlockCaches()
+
+	out := stdout.Prefixed("[" + cb.BatchIdentifier + "] ")
+	defer out.Close()
+
+	if len(cfg.LogFile) > 0 {
+		logFile, err := os.Create(cfg.LogFile)
+		if err != nil {
+			return RunSummary{ExitCode: -1}, err
+		}
+		defer logFile.Close()
+		cfg.Stdout, cfg.Stderr = logFile, logFile
+	} else {
+		errOut := stderr.Prefixed("[" + cb.BatchIdentifier + "] ")
+		defer errOut.Close()
+		cfg.Stdout, cfg.Stderr = out, errOut
+	}
+
+	summary, err := cb.Run(cfg)
+	if err != nil {
+		return summary, err
+	}
+
+	// Summary is written at once, so it is not mixed up with other builds
+	buf := &bytes.Buffer{}
+	summary.Print(buf)
+	out.Write(buf.Bytes())
+
+	return summary, nil
 }
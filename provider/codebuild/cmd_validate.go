@@ -0,0 +1,78 @@
+package codebuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/piotrkubisa/localcb/cmd"
+	"github.com/urfave/cli"
+)
+
+var validateFlags = struct {
+	Format cmd.FlagPair
+}{
+	Format: cmd.NewFlagPair("format", ""),
+}
+
+// ValidateCommand registers a cli.Command
+func ValidateCommand() cli.Command {
+	return cli.Command{
+		Name:      "validate",
+		Usage:     "Checks buildspec.yml files without running them (no Docker required)",
+		ArgsUsage: "[buildspec.yml...]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  validateFlags.Format.Join(),
+				Value: "text",
+				Usage: "Optional. Format of the diagnostics: text or json.",
+			},
+		},
+		Action: validateCommand,
+	}
+}
+
+func validateCommand(c *cli.Context) error {
+	files := []string(c.Args())
+	if len(files) == 0 {
+		files = []string{"buildspec.yml"}
+	}
+
+	format := c.String(validateFlags.Format.Long)
+	if format != "text" && format != "json" {
+		return fmt.Errorf("Unknown format (%s), use text or json", format)
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, f := range files {
+		d, err := ValidateBuildSpec(f)
+		if err != nil {
+			return err
+		}
+		diagnostics = append(diagnostics, d...)
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diagnostics); err != nil {
+			return err
+		}
+	} else {
+		for _, d := range diagnostics {
+			fmt.Println(d)
+		}
+	}
+
+	errs := 0
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			errs++
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("Found %d error(s) in %d file(s)", errs, len(files))
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/awslabs/goformation/cloudformation"
 	"github.com/docker/docker/api/types/container"
@@ -19,6 +20,12 @@ const (
 	envTag = "env"
 
 	guestWorkingDirectory = "/tmp/src"
+	defaultShell          = "sh"
+
+	// guestStateDirectory holds files which are read back by the localcb
+	// from the container when the build is finished
+	guestStateDirectory   = "/codebuild/localcb"
+	exportedVariablesFile = guestStateDirectory + "/exported-variables"
 )
 
 // CodeBuild mimics AWS CodeBuild runtime for the localcb
@@ -27,6 +34,25 @@ type CodeBuild struct {
 	Project    cloudformation.AWSCodeBuildProject
 	Pipeline   *ci.Pipeline
 	Script     *ShellScript
+	Parameters ParameterStore
+	Secrets    SecretsManager
+	Config     Config
+
+	// CacheModes lists enabled modes of the LOCAL cache of the project
+	CacheModes []string
+	// SourceVersion is a commit of the source directory or of the source
+	// checked out from the source cache (empty - the commit is not known)
+	SourceVersion string
+	// BatchIdentifier is an identifier of the build in the batch (empty - the
+	// build is not a part of a batch)
+	BatchIdentifier string
+	// Shard is a number of the build in the build fanout (0 - the build is
+	// not a shard)
+	Shard int
+	// GeneratedPaths are files and directories written by the localcb (i.e.
+	// the script and the artifacts directory), which are never collected
+	// into artifacts
+	GeneratedPaths []string
 }
 
 // NewCodeBuild creates new CodeBuild pipeline runtime
@@ -37,16 +63,36 @@ func NewCodeBuild(project cloudformation.AWSCodeBuildProject) (*CodeBuild, error
 		return nil, errors.Wrap(err, "localcb: ParseBuildSpec")
 	}
 
+	// Pick a way of running commands specific to the buildspec version
+	strategy, err := NewCommandStrategy(bs.Version)
+	if err != nil {
+		return nil, errors.Wrap(err, "localcb: NewCommandStrategy")
+	}
+
 	// Create a wrapper on top of the Docker client
 	pipeline, err := ci.NewPipeline()
 	if err != nil {
 		return nil, errors.Wrap(err, "localcb: ci.NewPipeline")
 	}
 
-	cb := &CodeBuild{bs, project, pipeline, NewShellScript()}
+	cb := &CodeBuild{
+		Definition: bs,
+		Project:    project,
+		Pipeline:   pipeline,
+		Script:     NewShellScript(strategy),
+	}
 	return cb, nil
 }
 
+// Shell returns the shell which should execute the localcb.sh script
+func (cb *CodeBuild) Shell() string {
+	if len(cb.Definition.Env.Shell) > 0 {
+		return cb.Definition.Env.Shell
+	}
+
+	return defaultShell
+}
+
 // WorkingDirectory returns working directory for the Docker client
 func (cb *CodeBuild) WorkingDirectory(customWorkDir string) string {
 	if len(customWorkDir) > 0 {
@@ -77,21 +123,39 @@ func (cb *CodeBuild) Volumes(customVolumes []string) ([]string, error) {
 
 // EnvVariables binds all variables to one common []string slice which can be
 // further passed to the Docker client.
-func (cb *CodeBuild) EnvVariables(customVariables []string) []string {
+func (cb *CodeBuild) EnvVariables(customVariables []string) ([]string, error) {
 	// Bind all default env variables
 	vars := cb.NewDefaultVariables().KeyValues()
 
+	if len(cb.BatchIdentifier) > 0 {
+		vars = append(vars, "CODEBUILD_BATCH_BUILD_IDENTIFIER="+cb.BatchIdentifier)
+	}
+
 	// Bind all env variables from the buildspec.yml definition file
 	for k, v := range cb.Definition.Env.Variables {
 		vars = append(vars, k+"="+v)
 	}
 
+	// Bind all env variables resolved from the local parameter store
+	params, err := cb.Parameters.Resolve(cb.Definition.Env.ParameterStore)
+	if err != nil {
+		return nil, err
+	}
+	vars = append(vars, params...)
+
+	// Bind all env variables resolved from the local secrets
+	secrets, err := cb.Secrets.Resolve(cb.Definition.Env.SecretsManager)
+	if err != nil {
+		return nil, err
+	}
+	vars = append(vars, secrets...)
+
 	// Bind all env variables given by the user via --env flags
 	if len(customVariables) > 0 {
 		vars = append(vars, customVariables...)
 	}
 
-	return vars
+	return vars, nil
 }
 
 // NewDefaultVariables parses all variables provided by default by the CodeBuild
@@ -107,6 +171,10 @@ func (cb *CodeBuild) NewDefaultVariables() DefaultVariables {
 		commitID     = "ffffffff"
 	)
 
+	if len(cb.SourceVersion) > 0 {
+		commitID = cb.SourceVersion
+	}
+
 	dv := DefaultVariables{
 		AwsDefaultRegion: awsRegion,
 		AwsRegion:        awsRegion,
@@ -131,6 +199,7 @@ func (cb *CodeBuild) NewDefaultVariables() DefaultVariables {
 		CodeBuildSourceRepoURL:         "s3://bucket_name/input_artifact.zip",
 		CodeBuildSrcDir:                guestWorkingDirectory,
 
+		// Home of the run-as user is resolved in the container
 		Home: "/root",
 	}
 
@@ -176,37 +245,106 @@ func (dv DefaultVariables) KeyValues() []string {
 	return varlist
 }
 
-// PhasesAsStages converts all codebuild.Phases to ci.Stages
-func (cb *CodeBuild) PhasesAsStages() {
-	cb.PhaseToStage(cb.Definition.Phases.Install, "install")
-	cb.PhaseToStage(cb.Definition.Phases.PreBuild, "pre_build")
-	cb.PhaseToStage(cb.Definition.Phases.Build, "build")
-	cb.PhaseToStage(cb.Definition.Phases.PostBuild, "post_build")
+// PhasesAsStages converts all codebuild.Phases to ci.Stages.
+// Failure of the build phase does not prevent post_build from running.
+func (cb *CodeBuild) PhasesAsStages() error {
+	runtimes, err := cb.RuntimeCommands()
+	if err != nil {
+		return errors.Wrap(err, "localcb: install phase")
+	}
+
+	install := cb.Definition.Phases.Install
+	install.Commands = append(runtimes, install.Commands...)
+
+	phases := []struct {
+		phase    Phase
+		name     string
+		fallback string
+	}{
+		{install, "install", ""},
+		{cb.Definition.Phases.PreBuild, "pre_build", ""},
+		{cb.Definition.Phases.Build, "build", "post_build"},
+		{cb.Definition.Phases.PostBuild, "post_build", ""},
+	}
+
+	for _, p := range phases {
+		if err := cb.PhaseToStage(p.phase, p.name, p.fallback); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // PhaseToStage parses codebuild.Phase as a ci.Stage
-func (cb *CodeBuild) PhaseToStage(p Phase, name string) {
+func (cb *CodeBuild) PhaseToStage(p Phase, name, fallback string) error {
+	onFailure, err := p.FailureAction()
+	if err != nil {
+		return errors.Wrapf(err, "localcb: %s phase", name)
+	}
+
 	commands := []ci.Command{}
 	for _, cmd := range p.Commands {
 		commands = append(commands, ci.NewCommand(cmd))
 	}
 
-	stage := ci.NewStage(name, commands)
+	finally := []ci.Command{}
+	for _, cmd := range p.Finally {
+		finally = append(finally, ci.NewCommand(cmd))
+	}
+
+	stage := ci.NewStage(name, commands, finally)
+	stage.OnFailure = onFailure
+	stage.Fallback = fallback
+	stage.User = cb.Definition.RunAs
+	if len(p.RunAs) > 0 {
+		stage.User = p.RunAs
+	}
 	cb.Pipeline.AddStage(stage)
+	return nil
 }
 
 // StagesAsScript saves a localcb.sh shell script into given basedir
 func (cb *CodeBuild) StagesAsScript(baseDir, scriptFile string) error {
+	cached, err := cb.cachedDirectories()
+	if err != nil {
+		return err
+	}
+
+	cb.Script.Shell = cb.Shell()
+	cb.Script.Begin()
+	if user := cb.Definition.RunAs; len(user) > 0 {
+		writeHome(cb.Script.Buffer, user)
+	}
+	if len(cached) > 0 {
+		cb.Script.RestoreCache(guestCacheDirectory, cached)
+	}
 	for _, stage := range cb.Pipeline.Stages {
 		cb.Script.ExtractStage(stage)
 	}
-	err := cb.SaveScript(baseDir + scriptFile)
+	if len(cached) > 0 {
+		cb.Script.SaveCache(guestCacheDirectory, cached)
+	}
+	cb.Script.End(cb.Definition.Env.ExportedVariables)
+	err = cb.SaveScript(baseDir + scriptFile)
 	if err != nil {
 		return errors.Wrap(err, "localcb: cb.StagesAsScript")
 	}
 	return nil
 }
 
+// cachedDirectories returns directories of the `cache.paths`, which are
+// restored and saved by the build (none, if the paths are not cached)
+func (cb *CodeBuild) cachedDirectories() ([]CachedDirectory, error) {
+	cached, err := cb.Definition.Cache.Directories()
+	if err != nil {
+		return nil, errors.Wrap(err, "localcb: cache.paths")
+	}
+	if !cb.CachesPaths() {
+		return nil, nil
+	}
+	return cached, nil
+}
+
 // SaveScript creates script (i.e. shell) file on host, which can be futher used
 // by the localcb during the runtime.
 func (cb *CodeBuild) SaveScript(location string) error {
@@ -225,14 +363,159 @@ func (cb *CodeBuild) SaveScript(location string) error {
 }
 
 type RunConfiguration struct {
-	LogFile          string
-	EnvVariables     []string
-	WorkingDirectory string
-	Volume           []string
-	ForcePullImage   bool
-	NetworkName      string
+	ScriptFile            string
+	LogFile               string
+	ExportedVariablesFile string
+	ReportsFile           string
+	EnvVariables          []string
+	SecretVariables       []string
+	WorkingDirectory      string
+	Volume                []string
+	ForcePullImage        bool
+	NetworkName           string
+
+	// Caches are mounted as volumes, so they have to exist beforehand
+	Caches []LocalCache
 
 	ContainerName string
+
+	// Exec runs each command with a separate docker exec in a long-living
+	// container, instead of the whole localcb.sh script at once
+	Exec bool
+	// CommandsFile receives results of the commands run in the exec mode
+	CommandsFile string
+
+	// Stdout and Stderr receive logs of the container and the summary of the
+	// build instead of the LogFile (nil - LogFile or os.Stdout is used)
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// IsSecret tells whether the env variable holds a value of a secret.
+func (cfg RunConfiguration) IsSecret(name string) bool {
+	for _, s := range cfg.SecretVariables {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalCaches returns caches used by the build, which are kept in the hostDir
+// or, if it is empty, in the Docker volumes. Source cache is always kept on
+// the host, by default in the cache directory of the user. Builds of the batch
+// run in parallel, so each of them has own caches.
+func (cb *CodeBuild) LocalCaches(hostDir string) ([]LocalCache, error) {
+	types := []string{}
+	if len(cb.Definition.Cache.Paths) > 0 && cb.CachesPaths() {
+		types = append(types, CachePaths)
+	}
+	if cb.HasCacheMode(CacheModeDockerLayer) {
+		types = append(types, CacheDockerLayer)
+	}
+	if cb.HasCacheMode(CacheModeSource) {
+		types = append(types, CacheSource)
+	}
+
+	project := cb.Project.Name
+	if len(cb.BatchIdentifier) > 0 {
+		project += "-" + cb.BatchIdentifier
+	}
+
+	caches := []LocalCache{}
+	for _, t := range types {
+		dir := hostDir
+		if t == CacheSource && dir == "" {
+			dir = defaultCacheDir()
+		}
+
+		lc, err := NewLocalCache(project, t, dir)
+		if err != nil {
+			return nil, err
+		}
+		caches = append(caches, lc)
+	}
+
+	return caches, nil
+}
+
+// CachesPaths tells whether `cache.paths` are kept between the builds. The
+// LOCAL cache of the project keeps them only in the LOCAL_CUSTOM_CACHE mode.
+func (cb *CodeBuild) CachesPaths() bool {
+	if cb.Project.Cache == nil {
+		return true
+	}
+
+	switch cb.Project.Cache.Type {
+	case "NO_CACHE":
+		return false
+	case "LOCAL":
+		return cb.HasCacheMode(CacheModeCustom)
+	}
+	return true
+}
+
+// SetCache configures cache of the project (nil - not configured) with the
+// enabled modes of the LOCAL cache.
+func (cb *CodeBuild) SetCache(cache *cloudformation.AWSCodeBuildProject_ProjectCache, modes []string) error {
+	for _, mode := range modes {
+		switch mode {
+		case CacheModeDockerLayer:
+			if !cb.Project.Environment.PrivilegedMode {
+				return fmt.Errorf("cache mode %s requires privileged mode", mode)
+			}
+		case CacheModeSource, CacheModeCustom:
+		default:
+			return fmt.Errorf("unknown cache mode (%s), expected %s, %s or %s",
+				mode, CacheModeDockerLayer, CacheModeSource, CacheModeCustom)
+		}
+	}
+
+	if len(modes) > 0 {
+		if cache == nil {
+			cache = &cloudformation.AWSCodeBuildProject_ProjectCache{Type: "LOCAL"}
+		}
+		if cache.Type != "LOCAL" {
+			return fmt.Errorf("cache modes require LOCAL cache type, got %s", cache.Type)
+		}
+	}
+
+	cb.Project.Cache = cache
+	cb.CacheModes = modes
+	return nil
+}
+
+// HasCacheMode tells whether the mode of the LOCAL cache is enabled
+func (cb *CodeBuild) HasCacheMode(mode string) bool {
+	for _, m := range cb.CacheModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheVolumes returns volumes (as in docker cli) which mount the caches
+func (cb *CodeBuild) CacheVolumes(caches []LocalCache) []string {
+	volumes := []string{}
+	for _, lc := range caches {
+		switch lc.Type {
+		case CachePaths:
+			volumes = append(volumes, lc.Bind(guestCacheDirectory))
+		case CacheDockerLayer:
+			volumes = append(volumes, lc.Bind(guestDockerDirectory))
+		}
+	}
+	return volumes
+}
+
+// SecretVariables returns names of the env variables resolved from secrets.
+func (cb *CodeBuild) SecretVariables() []string {
+	names := []string{}
+	for name := range cb.Definition.Env.SecretsManager {
+		names = append(names, name)
+	}
+	return names
 }
 
 func (cb *CodeBuild) Validate(cfg RunConfiguration) error {
@@ -240,10 +523,19 @@ func (cb *CodeBuild) Validate(cfg RunConfiguration) error {
 		return errors.New("Please specify value for --image flag")
 	}
 
-	return nil
+	// Thresholds of the batch are validated once, against report groups of
+	// all its builds (see runBatch)
+	if len(cb.BatchIdentifier) > 0 {
+		return nil
+	}
+	return cb.Config.Validate(cb.Definition.Reports)
 }
 
 func (cb *CodeBuild) DryRun(cfg RunConfiguration) {
+	for _, lc := range cfg.Caches {
+		fmt.Println(lc.PrepareCommand())
+	}
+
 	args := []string{"docker", "run"}
 
 	if cb.Project.Environment.PrivilegedMode {
@@ -254,6 +546,12 @@ func (cb *CodeBuild) DryRun(cfg RunConfiguration) {
 	args = append(args, "--interactive")
 
 	for _, v := range cfg.EnvVariables {
+		// Values of secrets are never printed, docker will take them from
+		// the env variables of the host instead
+		if name := strings.SplitN(v, "=", 2)[0]; cfg.IsSecret(name) {
+			args = append(args, "--env", name)
+			continue
+		}
 		args = append(args, "--env", fmt.Sprintf(`'%s'`, v))
 	}
 
@@ -265,50 +563,203 @@ func (cb *CodeBuild) DryRun(cfg RunConfiguration) {
 	args = append(args, "--entrypoint", "dockerd-entrypoint.sh")
 
 	args = append(args, cb.Project.Environment.Image)
-	args = append(args, "sh", "./localcb.sh")
+	args = append(args, cb.Shell(), "./"+cfg.ScriptFile)
+	if cfg.Exec {
+		fmt.Println("# With --exec commands of the script are run one by one with docker exec")
+	}
 	fmt.Println(strings.Join(args, " "))
 }
 
-// RunInContainer starts Docker container and executes localcb.sh shell script
+// RunInContainer starts Docker container, executes localcb.sh shell script and
+// prints the summary of the build. Caches of the configuration have to be
+// locked by the caller.
 func (cb *CodeBuild) RunInContainer(cfg RunConfiguration) error {
+	summary, err := cb.Run(cfg)
+	if err != nil {
+		return err
+	}
+
+	stdout := cfg.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	summary.Print(stdout)
+
+	return summary.Err()
+}
+
+// Run starts Docker container, executes localcb.sh shell script and collects
+// results of the build. Failure of the build itself is not an error, it is
+// reported by the summary.
+func (cb *CodeBuild) Run(cfg RunConfiguration) (RunSummary, error) {
+	summary := RunSummary{ExitCode: -1}
+
 	_, err := cb.Pipeline.DockerVersion()
 	if err != nil {
 		log.Printf("localcb requires Docker. Do you have docker installed and running as a service on your machine?")
-		return errors.Wrap(err, "localcb: cb.Pipeline.DockerVersion")
+		return summary, errors.Wrap(err, "localcb: cb.Pipeline.DockerVersion")
 	}
 
 	if err := cb.Pipeline.PullImage(cb.Project.Environment.Image, cfg.ForcePullImage); err != nil {
-		return errors.Wrap(err, "localcb: cb.Pipeline.PullImage")
+		return summary, errors.Wrap(err, "localcb: cb.Pipeline.PullImage")
+	}
+
+	found, err := cb.Pipeline.ImageHasExecutable(cb.Project.Environment.Image, cb.Shell())
+	if err != nil {
+		return summary, errors.Wrap(err, "localcb: cb.Pipeline.ImageHasExecutable")
+	}
+	if !found {
+		return summary, fmt.Errorf("localcb: shell %s (env.shell) is not available in the %s image", cb.Shell(), cb.Project.Environment.Image)
+	}
+
+	for _, lc := range cfg.Caches {
+		if err := lc.Prepare(cb.Pipeline); err != nil {
+			return summary, errors.Wrap(err, "localcb: LocalCache.Prepare")
+		}
 	}
 
 	cont, err := cb.CreateContainer(cfg)
 	if err != nil {
-		return errors.Wrap(err, "localcb: cb.Pipeline.CreateContainer")
+		return summary, errors.Wrap(err, "localcb: cb.Pipeline.CreateContainer")
+	}
+	release := cb.Pipeline.InterruptHandler(cont.ID)
+	defer release()
+	defer cb.Pipeline.CleanUp(cont.ID)
+
+	err = cb.Pipeline.CopyToContainer(cont.ID, "/", helperFiles(), 0755)
+	if err != nil {
+		return summary, errors.Wrap(err, "localcb: cb.Pipeline.CopyToContainer")
 	}
 
 	if cfg.NetworkName != "" {
 		err = cb.Pipeline.NetworkConnect(cont.ID, cfg.NetworkName)
 		if err != nil {
-			return errors.Wrap(err, "localcb: cb.Pipeline.NetworkConnect")
+			return summary, errors.Wrap(err, "localcb: cb.Pipeline.NetworkConnect")
 		}
 	}
 
+	startedOn := time.Now()
 	err = cb.Pipeline.ContainerStart(cont.ID)
 	if err != nil {
-		return errors.Wrap(err, "localcb: cb.Pipeline.ContainerStart")
+		return summary, errors.Wrap(err, "localcb: cb.Pipeline.ContainerStart")
 	}
 
-	stdout, stderr, err := cb.Pipeline.ContainerAttach(cont.ID)
+	var exitCode int64
+	if cfg.Exec {
+		exitCode, summary.Commands, err = cb.runExec(cont.ID, cfg)
+	} else {
+		exitCode, err = cb.runScript(cont.ID, cfg)
+	}
 	if err != nil {
-		return errors.Wrap(err, "localcb: cb.Pipeline.ContainerAttach")
+		return summary, err
 	}
 
-	cb.Pipeline.InterruptHandler(stdout, stderr, cont.ID)
-	cb.Pipeline.LogWatch(stdout, stderr, cont.ID, cfg.LogFile)
+	summary.ExitCode = exitCode
+	if len(cb.Definition.Env.ExportedVariables) > 0 {
+		summary.ExportedVariables, err = cb.ExportedVariables(cont.ID)
+		if err != nil {
+			return summary, errors.Wrap(err, "localcb: cb.ExportedVariables")
+		}
 
-	defer cb.Pipeline.CleanUp(cont.ID)
+		err = summary.ExportedVariables.Save(cfg.ExportedVariablesFile)
+		if err != nil {
+			return summary, errors.Wrap(err, "localcb: ExportedVariables.Save")
+		}
+	}
 
-	return nil
+	if len(cb.Definition.Reports) > 0 {
+		summary.Reports = cb.CollectReports()
+
+		err = SaveReports(cfg.ReportsFile, summary.Reports)
+		if err != nil {
+			return summary, errors.Wrap(err, "localcb: SaveReports")
+		}
+	}
+
+	if exitCode == 0 {
+		imageDigest, err := cb.Pipeline.ImageDigest(cb.Project.Environment.Image)
+		if err != nil {
+			return summary, errors.Wrap(err, "localcb: cb.Pipeline.ImageDigest")
+		}
+
+		provenance := cb.NewProvenance(cfg, imageDigest, startedOn)
+		summary.Artifacts, err = cb.CollectArtifacts(provenance)
+		if err != nil {
+			return summary, errors.Wrap(err, "localcb: cb.CollectArtifacts")
+		}
+	}
+
+	return summary, nil
+}
+
+// runScript waits until the localcb.sh script, run by the container, ends
+// and returns its exit code. Logs of the container are streamed meanwhile.
+func (cb *CodeBuild) runScript(contID string, cfg RunConfiguration) (int64, error) {
+	stdout, stderr, err := cb.Pipeline.ContainerAttach(contID)
+	if err != nil {
+		return -1, errors.Wrap(err, "localcb: cb.Pipeline.ContainerAttach")
+	}
+
+	if cfg.Stdout != nil {
+		cb.Pipeline.LogCopy(stdout, stderr, cfg.Stdout, cfg.Stderr)
+	} else {
+		cb.Pipeline.LogWatch(stdout, stderr, cfg.LogFile)
+	}
+
+	exitCode, err := cb.Pipeline.ContainerWait(contID)
+	if err != nil {
+		return -1, errors.Wrap(err, "localcb: cb.Pipeline.ContainerWait")
+	}
+	return exitCode, nil
+}
+
+// runExec runs commands of the stages one by one in the container and saves
+// their results to the CommandsFile.
+func (cb *CodeBuild) runExec(contID string, cfg RunConfiguration) (int64, []CommandResult, error) {
+	stdout, stderr := cfg.Stdout, cfg.Stderr
+	if stdout == nil {
+		stdout, stderr = os.Stdout, os.Stderr
+		if len(cfg.LogFile) > 0 {
+			logFile, err := os.Create(cfg.LogFile)
+			if err != nil {
+				return -1, nil, errors.Wrap(err, "localcb: log file")
+			}
+			defer logFile.Close()
+			stdout, stderr = logFile, logFile
+			log.SetOutput(logFile)
+			defer log.SetOutput(os.Stderr)
+		}
+	}
+
+	exitCode, commands, err := cb.ExecStages(contID, stdout, stderr)
+	if err != nil {
+		return exitCode, commands, err
+	}
+
+	if len(cfg.CommandsFile) > 0 {
+		err = SaveCommands(cfg.CommandsFile, commands)
+		if err != nil {
+			return exitCode, commands, errors.Wrap(err, "localcb: SaveCommands")
+		}
+	}
+	return exitCode, commands, nil
+}
+
+// ExportedVariables reads values of the `exported-variables` captured by the
+// localcb.sh script at the end of the build. When the script has not reached
+// its end (i.e. the container was killed), all variables are considered as
+// not set.
+func (cb *CodeBuild) ExportedVariables(contID string) (ExportedVariables, error) {
+	contents, err := cb.Pipeline.CopyFromContainer(contID, exportedVariablesFile)
+	if ci.IsNotFound(err) {
+		log.Printf("Exported variables were not captured, the build has not reached its end")
+		contents, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseExportedVariables(cb.Definition.Env.ExportedVariables, contents), nil
 }
 
 // CreateContainer creates a Docker container with given configuration
@@ -319,7 +770,10 @@ func (cb *CodeBuild) CreateContainer(cfg RunConfiguration) (container.ContainerC
 		Env:        cfg.EnvVariables,
 		WorkingDir: cfg.WorkingDirectory,
 		Entrypoint: []string{"dockerd-entrypoint.sh"},
-		Cmd:        []string{"sh", "./localcb.sh"},
+		Cmd:        []string{cb.Shell(), "./" + cfg.ScriptFile},
+	}
+	if cfg.Exec {
+		config.Cmd = cb.execIdleCommand()
 	}
 	host := &container.HostConfig{
 		Binds:      cfg.Volume,
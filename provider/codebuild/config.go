@@ -0,0 +1,91 @@
+package codebuild
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/sanathkr/yaml"
+)
+
+// defaultConfigFiles are looked up in the project directory when the location
+// of the localcb config has not been given.
+var defaultConfigFiles = []string{
+	"localcb.yml",
+	"localcb.yaml",
+	"localcb.json",
+}
+
+// Config holds settings of the local builds, which have no place in the
+// buildspec, i.e. minimum code coverage of the report groups:
+//
+//	coverage-thresholds:
+//	  coverage-report:
+//	    line: 80
+//	    branch: 60
+type Config struct {
+	Location           string                       `json:"-"`
+	CoverageThresholds map[string]CoverageThreshold `json:"coverage-thresholds"`
+}
+
+// CoverageThreshold defines minimum line and branch coverage (in percent) of
+// the report group, zero means the coverage is not checked.
+type CoverageThreshold struct {
+	Line   float64 `json:"line"`
+	Branch float64 `json:"branch"`
+}
+
+// LoadConfig reads the localcb config from a YAML or JSON file, an empty
+// config is returned when there is no such file.
+func LoadConfig(location, baseDir string) (Config, error) {
+	location = findLocalFile(location, baseDir, defaultConfigFiles)
+
+	cfg := Config{Location: location}
+	if location == "" {
+		return cfg, nil
+	}
+
+	contents, err := ioutil.ReadFile(location)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = yaml.Unmarshal(contents, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("cannot parse localcb config %s: %s", location, err)
+	}
+	cfg.Location = location
+
+	return cfg, nil
+}
+
+// Validate checks whether thresholds refer to the code coverage report groups
+// defined in the buildspec.
+func (cfg Config) Validate(reports map[string]ReportGroup) error {
+	names := []string{}
+	for name := range cfg.CoverageThresholds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rg, ok := reports[name]
+		if !ok {
+			return fmt.Errorf("%s: coverage threshold of %s, which is not defined in the reports section", cfg.Location, name)
+		}
+		if _, ok := coverageParsers[rg.FileFormat]; !ok {
+			return fmt.Errorf("%s: coverage threshold of %s, which is not a code coverage report (file-format %s)", cfg.Location, name, rg.FileFormat)
+		}
+	}
+
+	return nil
+}
+
+// checkThresholds checks the code coverage of reports which have thresholds
+func (cfg Config) checkThresholds(reports []Report) {
+	for i := range reports {
+		if threshold, ok := cfg.CoverageThresholds[reports[i].Name]; ok {
+			reports[i].checkCoverage(threshold)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package codebuild
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/piotrkubisa/localcb/ci"
+	"github.com/pkg/errors"
+)
+
+const (
+	// execStateFile holds env variables and the current directory of the
+	// shell, which are restored before each command in the exec mode
+	execStateFile = guestStateDirectory + "/exec-state"
+	// execReadyFile is created once the entrypoint of the container has
+	// finished and commands can be run
+	execReadyFile    = guestStateDirectory + "/exec-ready"
+	execReadyTimeout = 2 * time.Minute
+)
+
+// CommandResult describes a single command run in the exec mode
+type CommandResult struct {
+	Phase     string    `json:"phase"`
+	Command   string    `json:"command"`
+	Finally   bool      `json:"finally,omitempty"`
+	ExitCode  int       `json:"exitCode"`
+	StartedOn time.Time `json:"startTime"`
+	EndedOn   time.Time `json:"endTime"`
+	// Output holds both stdout and stderr of the command
+	Output string `json:"output"`
+}
+
+// Duration returns how long the command has run
+func (r CommandResult) Duration() time.Duration {
+	return r.EndedOn.Sub(r.StartedOn)
+}
+
+// SaveCommands writes results of the commands to a JSON file
+func SaveCommands(location string, commands []CommandResult) error {
+	return saveJSON(location, commands)
+}
+
+// execIdleCommand keeps the container running in the exec mode, until it is
+// removed by the localcb
+func (cb *CodeBuild) execIdleCommand() []string {
+	return []string{cb.Shell(), "-c", fmt.Sprintf("touch '%s' && trap 'exit 0' TERM && while :; do sleep 1; done", execReadyFile)}
+}
+
+// commandExecutor runs commands of the stages one by one in the container,
+// mirroring the flow of the localcb.sh script.
+type commandExecutor struct {
+	cb     *CodeBuild
+	contID string
+	stdout io.Writer
+	stderr io.Writer
+
+	// sharedState carries env variables and the current directory over to
+	// the next command (buildspec version 0.2)
+	sharedState bool
+	failed      bool
+	results     []CommandResult
+}
+
+// ExecStages runs the stages in the started container, each command with a
+// separate docker exec, and returns the exit code of the build and results of
+// the commands.
+func (cb *CodeBuild) ExecStages(contID string, stdout, stderr io.Writer) (int64, []CommandResult, error) {
+	e := &commandExecutor{
+		cb:          cb,
+		contID:      contID,
+		stdout:      stdout,
+		stderr:      stderr,
+		sharedState: cb.Definition.Version != "0.1",
+	}
+
+	if err := e.waitReady(); err != nil {
+		return -1, nil, err
+	}
+
+	cached, err := cb.cachedDirectories()
+	if err != nil {
+		return -1, nil, err
+	}
+	if len(cached) > 0 {
+		if err := e.snippet(func(sr *ShellScript) { sr.RestoreCache(guestCacheDirectory, cached) }); err != nil {
+			return -1, nil, err
+		}
+	}
+
+	skipTo := ""
+	for _, stage := range cb.Pipeline.Stages {
+		if len(skipTo) > 0 && skipTo != stage.Name {
+			continue
+		}
+		skipTo = ""
+
+		succeeded, err := e.runStage(stage)
+		if err != nil {
+			return -1, e.results, err
+		}
+		if !succeeded && stage.OnFailure == ci.Abort {
+			skipTo = stage.Fallback
+			if skipTo == "" {
+				skipTo = "-"
+			}
+		}
+	}
+
+	if len(cached) > 0 && !e.failed {
+		if err := e.snippet(func(sr *ShellScript) { sr.SaveCache(guestCacheDirectory, cached) }); err != nil {
+			return -1, e.results, err
+		}
+	}
+
+	if exported := cb.Definition.Env.ExportedVariables; len(exported) > 0 {
+		w := &bytes.Buffer{}
+		writeExportedVariables(w, exported)
+		if _, err := e.exec("", e.wrap(nil, w.String()), e.stdout, e.stderr); err != nil {
+			return -1, e.results, err
+		}
+	}
+
+	if e.failed {
+		return 1, e.results, nil
+	}
+	return 0, e.results, nil
+}
+
+// waitReady waits for the entrypoint of the container, i.e. until the Docker
+// daemon is started in the privileged mode
+func (e *commandExecutor) waitReady() error {
+	deadline := time.Now().Add(execReadyTimeout)
+	for {
+		code, err := e.exec("", fmt.Sprintf("[ -f '%s' ]", execReadyFile), ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			return err
+		}
+		if code == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("localcb: container is not ready after %s", execReadyTimeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// runStage runs commands of the stage until the first failing one, the
+// finally commands are always run. It tells whether the stage has succeeded,
+// a failed stage fails the whole build.
+func (e *commandExecutor) runStage(stage *ci.Stage) (bool, error) {
+	phase := strings.ToUpper(stage.Name)
+	fmt.Fprintf(e.stdout, "[Container] Entering phase %s\n", phase)
+
+	status, err := e.runCommands(stage, stage.Commands, false)
+	if err != nil {
+		return false, err
+	}
+	if len(stage.Finally) > 0 {
+		finallyStatus, err := e.runCommands(stage, stage.Finally, true)
+		if err != nil {
+			return false, err
+		}
+		if status == 0 {
+			status = finallyStatus
+		}
+	}
+
+	if status != 0 {
+		fmt.Fprintf(e.stdout, "[Container] Phase complete: %s State: FAILED\n", phase)
+		e.failed = true
+		return false, nil
+	}
+	fmt.Fprintf(e.stdout, "[Container] Phase complete: %s State: SUCCEEDED\n", phase)
+	return true, nil
+}
+
+// runCommands runs the commands one by one and returns the exit code of the
+// first one that failed
+func (e *commandExecutor) runCommands(stage *ci.Stage, cmds []ci.Command, finally bool) (int, error) {
+	for _, cmd := range cmds {
+		fmt.Fprintf(e.stdout, "[Container] Running command %s\n", cmd.Exec)
+
+		output := &bytes.Buffer{}
+		r := CommandResult{
+			Phase:     strings.ToUpper(stage.Name),
+			Command:   cmd.Exec,
+			Finally:   finally,
+			StartedOn: time.Now(),
+		}
+		code, err := e.exec(stage.User, e.wrap(stage, cmd.Exec), io.MultiWriter(e.stdout, output), io.MultiWriter(e.stderr, output))
+		if err != nil {
+			return -1, err
+		}
+		r.EndedOn = time.Now()
+		r.ExitCode = code
+		r.Output = output.String()
+		e.results = append(e.results, r)
+
+		if code != 0 {
+			fmt.Fprintf(e.stdout, "[Container] Command did not exit successfully %s exit status %d\n", cmd.Exec, code)
+			return code, nil
+		}
+	}
+	return 0, nil
+}
+
+// wrap prepares the script of a single command: the state of the shell left
+// by the previous command is restored and saved again once the command exits.
+// Stages run as another user keep their state separately, so as in the
+// localcb.sh script, their variables are not visible outside of the stage.
+func (e *commandExecutor) wrap(stage *ci.Stage, cmd string) string {
+	user := ""
+	if stage != nil {
+		user = stage.User
+	}
+
+	w := &bytes.Buffer{}
+	state := execStateFile
+	if e.sharedState {
+		if len(user) > 0 {
+			state = "/tmp/localcb-exec-state-" + stage.Name
+			fmt.Fprintf(w, "if [ -f '%s' ]; then . '%s'; elif [ -f '%s' ]; then . '%s'; fi\n", state, state, execStateFile, execStateFile)
+		} else {
+			fmt.Fprintf(w, "if [ -f '%s' ]; then . '%s'; fi\n", state, state)
+		}
+	}
+	if len(user) > 0 {
+		writeHome(w, user)
+	}
+	if e.failed {
+		io.WriteString(w, "CODEBUILD_BUILD_SUCCEEDING=0\n")
+		io.WriteString(w, "export CODEBUILD_BUILD_SUCCEEDING\n")
+	}
+	fmt.Fprintf(w, "case \":$PATH:\" in *':%s:'*) ;; *) PATH=\"$PATH:%s\" ;; esac\n", guestBinDirectory, guestBinDirectory)
+	io.WriteString(w, "export PATH\n")
+
+	if e.sharedState {
+		fmt.Fprintf(w, saveStateTrap+"\n", state)
+		io.WriteString(w, "set -a\n")
+	}
+	io.WriteString(w, cmd)
+	io.WriteString(w, "\n")
+	return w.String()
+}
+
+// snippet runs a part of the localcb.sh script, which does not depend on the
+// state of the shell (i.e. restoring the cache)
+func (e *commandExecutor) snippet(write func(sr *ShellScript)) error {
+	sr := NewShellScript(e.cb.Script.Strategy)
+	io.WriteString(sr.Buffer, "localcb_failed=0\n")
+	io.WriteString(sr.Buffer, "localcb_src_dir=\"$(pwd)\"\n")
+	if user := e.cb.Definition.RunAs; len(user) > 0 {
+		writeHome(sr.Buffer, user)
+	}
+	write(sr)
+
+	_, err := e.exec("", sr.Buffer.String(), e.stdout, e.stderr)
+	return err
+}
+
+func (e *commandExecutor) exec(user, script string, stdout, stderr io.Writer) (int, error) {
+	code, err := e.cb.Pipeline.ContainerExec(e.contID, user, []string{e.cb.Shell(), "-c", script}, nil, stdout, stderr)
+	if err != nil {
+		return -1, errors.Wrap(err, "localcb: cb.Pipeline.ContainerExec")
+	}
+	return code, nil
+}
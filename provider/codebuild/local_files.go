@@ -0,0 +1,36 @@
+package codebuild
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// findLocalFile returns the location of a local file (i.e. the localcb config
+// or the local parameter store). If location is empty, default file names are
+// looked up in baseDir and an empty location is returned when none of them
+// exists.
+func findLocalFile(location, baseDir string, names []string) string {
+	if location != "" {
+		return location
+	}
+
+	for _, name := range names {
+		candidate := filepath.Join(baseDir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// saveJSON writes the value to an indented JSON file
+func saveJSON(location string, v interface{}) error {
+	contents, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(location, contents, 0644)
+}
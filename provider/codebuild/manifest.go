@@ -0,0 +1,218 @@
+package codebuild
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Types of the in-toto statement and the SLSA provenance predicate
+const (
+	statementType  = "https://in-toto.io/Statement/v1"
+	predicateType  = "https://slsa.dev/provenance/v1"
+	buildType      = "https://github.com/piotrkubisa/localcb/codebuild@v1"
+	builderID      = "https://github.com/piotrkubisa/localcb"
+	manifestSuffix = ".intoto.json"
+)
+
+// Provenance describes how the artifacts have been built
+type Provenance struct {
+	BuildID       string
+	ProjectName   string
+	BuildSpec     string
+	BuildSpecFile string
+	Image         string
+	ImageDigest   string
+	SourceVersion string
+	// EnvVariables holds only names of the env variables, never values
+	EnvVariables []string
+	StartedOn    time.Time
+	FinishedOn   time.Time
+}
+
+// NewProvenance gathers provenance of the build run with given configuration.
+// The source is a dependency of the build only when its commit is known.
+func (cb *CodeBuild) NewProvenance(cfg RunConfiguration, imageDigest string, startedOn time.Time) Provenance {
+	p := Provenance{
+		BuildID:       cb.NewDefaultVariables().CodeBuildBuildID,
+		ProjectName:   cb.Project.Name,
+		BuildSpec:     cb.Project.Source.BuildSpec,
+		Image:         cb.Project.Environment.Image,
+		ImageDigest:   imageDigest,
+		SourceVersion: cb.SourceVersion,
+		StartedOn:     startedOn,
+		FinishedOn:    time.Now(),
+	}
+
+	// Relative buildspec is read from the current directory or, if it is not
+	// there, from the source directory
+	p.BuildSpecFile = p.BuildSpec
+	if _, err := os.Stat(p.BuildSpecFile); err != nil && !filepath.IsAbs(p.BuildSpecFile) {
+		p.BuildSpecFile = filepath.Join(cb.Project.Source.Location, p.BuildSpecFile)
+	}
+
+	seen := map[string]bool{}
+	for _, v := range cfg.EnvVariables {
+		kv := strings.SplitN(v, "=", 2)
+		if !seen[kv[0]] {
+			seen[kv[0]] = true
+			p.EnvVariables = append(p.EnvVariables, kv[0])
+		}
+	}
+	sort.Strings(p.EnvVariables)
+
+	return p
+}
+
+// Statement is an in-toto statement with the SLSA provenance predicate
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     ProvenancePredicate  `json:"predicate"`
+}
+
+// ResourceDescriptor describes a file of the artifact or a build dependency
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest"`
+	Annotations map[string]int64  `json:"annotations,omitempty"`
+}
+
+// ProvenancePredicate follows the SLSA provenance v1 format
+type ProvenancePredicate struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   map[string]string    `json:"externalParameters"`
+		InternalParameters   map[string][]string  `json:"internalParameters"`
+		ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string `json:"invocationId"`
+			StartedOn    string `json:"startedOn"`
+			FinishedOn   string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// WriteManifest saves a manifest of the artifact files (their paths, sizes and
+// SHA256 digests) with the provenance of the build, next to the artifact.
+func WriteManifest(artifact CollectedArtifact, files []ArtifactFile, p Provenance) (string, error) {
+	st := Statement{
+		Type:          statementType,
+		Subject:       []ResourceDescriptor{},
+		PredicateType: predicateType,
+	}
+
+	for _, f := range files {
+		digest, size, err := fileDigest(f)
+		if err != nil {
+			return "", err
+		}
+		if digest == "" {
+			continue
+		}
+		st.Subject = append(st.Subject, ResourceDescriptor{
+			Name:        f.Target,
+			Digest:      map[string]string{"sha256": digest},
+			Annotations: map[string]int64{"size": size},
+		})
+	}
+
+	bd := &st.Predicate.BuildDefinition
+	bd.BuildType = buildType
+	bd.ExternalParameters = map[string]string{
+		"project":   p.ProjectName,
+		"buildspec": p.BuildSpec,
+		"image":     p.Image,
+	}
+	if len(artifact.Identifier) > 0 {
+		bd.ExternalParameters["artifactIdentifier"] = artifact.Identifier
+	}
+	bd.InternalParameters = map[string][]string{"envVariables": p.EnvVariables}
+
+	digest, _, err := fileDigest(ArtifactFile{Source: p.BuildSpecFile})
+	if err != nil {
+		return "", fmt.Errorf("cannot compute digest of the buildspec %s: %s", p.BuildSpec, err)
+	}
+	bd.ResolvedDependencies = []ResourceDescriptor{{
+		Name:   p.BuildSpec,
+		Digest: map[string]string{"sha256": digest},
+	}}
+	if len(p.ImageDigest) > 0 {
+		bd.ResolvedDependencies = append(bd.ResolvedDependencies, ResourceDescriptor{
+			URI:    "docker://" + p.Image,
+			Digest: map[string]string{"sha256": strings.TrimPrefix(p.ImageDigest, "sha256:")},
+		})
+	}
+	if len(p.SourceVersion) > 0 {
+		bd.ResolvedDependencies = append(bd.ResolvedDependencies, ResourceDescriptor{
+			Name:   "source",
+			Digest: map[string]string{"gitCommit": p.SourceVersion},
+		})
+	}
+
+	rd := &st.Predicate.RunDetails
+	rd.Builder.ID = builderID
+	rd.Metadata.InvocationID = p.BuildID
+	rd.Metadata.StartedOn = p.StartedOn.UTC().Format(time.RFC3339)
+	rd.Metadata.FinishedOn = p.FinishedOn.UTC().Format(time.RFC3339)
+
+	contents, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	location := artifact.Location + manifestSuffix
+	return location, ioutil.WriteFile(location, contents, 0644)
+}
+
+// fileDigest computes SHA256 digest and size of the file as it is stored in
+// the artifact (a symlink is represented by its target). Directories are
+// not stored, so an empty digest is returned for them.
+func fileDigest(f ArtifactFile) (string, int64, error) {
+	h := sha256.New()
+
+	if f.Symlink {
+		target, err := os.Readlink(f.Source)
+		if err != nil {
+			return "", 0, err
+		}
+		n, _ := io.WriteString(h, target)
+		return hex.EncodeToString(h.Sum(nil)), int64(n), nil
+	}
+
+	src, err := os.Open(f.Source)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	if info.IsDir() {
+		return "", 0, nil
+	}
+
+	size, err := io.Copy(h, src)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
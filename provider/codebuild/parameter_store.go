@@ -0,0 +1,78 @@
+package codebuild
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/sanathkr/yaml"
+)
+
+// defaultParameterStoreFiles are looked up in the project directory when the
+// location of the local parameter store has not been given.
+var defaultParameterStoreFiles = []string{
+	"localcb-parameters.yml",
+	"localcb-parameters.yaml",
+	"localcb-parameters.json",
+}
+
+// ParameterStore is a local, file-backed stand-in for the AWS Systems Manager
+// Parameter Store. It maps names of the parameters to their values, i.e.:
+//
+//	/my-app/db/password: "s3cr3t"
+//	/my-app/db/host: "localhost"
+type ParameterStore struct {
+	Location   string
+	Parameters map[string]string
+}
+
+// LoadParameterStore reads the local parameter store from the given YAML or
+// JSON file, or from one of the default files in baseDir (see findLocalFile).
+func LoadParameterStore(location, baseDir string) (ParameterStore, error) {
+	location = findLocalFile(location, baseDir, defaultParameterStoreFiles)
+
+	ps := ParameterStore{Location: location}
+	if location == "" {
+		return ps, nil
+	}
+
+	contents, err := ioutil.ReadFile(location)
+	if err != nil {
+		return ps, err
+	}
+
+	err = yaml.Unmarshal(contents, &ps.Parameters)
+	if err != nil {
+		return ps, fmt.Errorf("cannot parse local parameter store %s: %s", location, err)
+	}
+
+	return ps, nil
+}
+
+// Resolve looks up parameters referenced in the `parameter-store` section of
+// the buildspec and returns them as key=value env variables.
+func (ps ParameterStore) Resolve(refs map[string]string) ([]string, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if ps.Location == "" {
+		return nil, fmt.Errorf("buildspec uses env.parameter-store, but there is no local parameter store (use --parameters-file or create %s)", defaultParameterStoreFiles[0])
+	}
+
+	names := []string{}
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := []string{}
+	for _, name := range names {
+		value, ok := ps.Parameters[refs[name]]
+		if !ok {
+			return nil, fmt.Errorf("parameter %s (env.parameter-store.%s) not found in %s", refs[name], name, ps.Location)
+		}
+		vars = append(vars, name+"="+value)
+	}
+
+	return vars, nil
+}
@@ -0,0 +1,86 @@
+package codebuild
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/awslabs/goformation"
+	"github.com/awslabs/goformation/cloudformation"
+)
+
+const codeBuildProjectType = "AWS::CodeBuild::Project"
+
+// LoadProjectCache reads cache configuration of the AWS::CodeBuild::Project
+// resource from the CloudFormation template, so local builds use the same
+// cache modes as the deployed project. The resource can be omitted when the
+// template defines only one project.
+func LoadProjectCache(templateFile, resource string) (*cloudformation.AWSCodeBuildProject_ProjectCache, []string, error) {
+	template, err := goformation.Open(templateFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	properties, err := projectProperties(template, resource)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// ProjectCache of the goformation does not know about modes, so they are
+	// read from the raw definition
+	raw, ok := properties["Cache"].(map[string]interface{})
+	if !ok {
+		return nil, nil, nil
+	}
+
+	cache := &cloudformation.AWSCodeBuildProject_ProjectCache{}
+	cache.Type, _ = raw["Type"].(string)
+	cache.Location, _ = raw["Location"].(string)
+
+	modes := []string{}
+	list, _ := raw["Modes"].([]interface{})
+	for _, m := range list {
+		mode, ok := m.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("Cache.Modes must be a list of strings, got %v", m)
+		}
+		modes = append(modes, mode)
+	}
+
+	return cache, modes, nil
+}
+
+// projectProperties returns properties of the AWS::CodeBuild::Project resource
+func projectProperties(template *cloudformation.Template, resource string) (map[string]interface{}, error) {
+	projects := map[string]map[string]interface{}{}
+	for name, r := range template.Resources {
+		definition, ok := r.(map[string]interface{})
+		if !ok || definition["Type"] != codeBuildProjectType {
+			continue
+		}
+		properties, _ := definition["Properties"].(map[string]interface{})
+		projects[name] = properties
+	}
+
+	if len(resource) > 0 {
+		properties, ok := projects[resource]
+		if !ok {
+			return nil, fmt.Errorf("resource %s of type %s not found in the template", resource, codeBuildProjectType)
+		}
+		return properties, nil
+	}
+
+	names := []string{}
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch len(names) {
+	case 0:
+		return nil, fmt.Errorf("no %s resources found in the template", codeBuildProjectType)
+	case 1:
+		return projects[names[0]], nil
+	}
+	return nil, fmt.Errorf("template defines many projects (%s), select one with --template-resource", strings.Join(names, ", "))
+}
@@ -0,0 +1,337 @@
+package codebuild
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats of the test reports supported by the localcb
+const (
+	FormatJUnit    = "JUNITXML"
+	FormatCucumber = "CUCUMBERJSON"
+	FormatTestNG   = "TESTNGXML"
+	FormatNUnit    = "NUNITXML"
+	FormatNUnit3   = "NUNIT3XML"
+)
+
+// Statuses of the test cases, as in the AWS CodeBuild
+const (
+	TestSucceeded = "SUCCEEDED"
+	TestFailed    = "FAILED"
+	TestError     = "ERROR"
+	TestSkipped   = "SKIPPED"
+	TestUnknown   = "UNKNOWN"
+)
+
+// Statuses of the reports, as in the AWS CodeBuild
+const (
+	ReportSucceeded  = "SUCCEEDED"
+	ReportFailed     = "FAILED"
+	ReportIncomplete = "INCOMPLETE"
+)
+
+// slowestTests is a number of the slowest tests shown in the summary
+const slowestTests = 5
+
+// reportParser reads test cases from the contents of a single report file
+type reportParser func(contents []byte) ([]TestCase, error)
+
+var reportParsers = map[string]reportParser{
+	FormatJUnit:    parseJUnit,
+	FormatCucumber: parseCucumber,
+	FormatTestNG:   parseTestNG,
+	FormatNUnit:    parseNUnit,
+	FormatNUnit3:   parseNUnit3,
+}
+
+// TestCase is a single test found in the report files
+type TestCase struct {
+	Prefix   string `json:"prefix,omitempty"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Duration int64  `json:"durationInNanoSeconds"`
+	Message  string `json:"message,omitempty"`
+	File     string `json:"testRawDataPath"`
+}
+
+// FullName joins the prefix (i.e. a class or a suite) and the name of the test
+func (tc TestCase) FullName() string {
+	if len(tc.Prefix) == 0 {
+		return tc.Name
+	}
+
+	return tc.Prefix + "." + tc.Name
+}
+
+// TestSummary counts test cases of the report by their status
+type TestSummary struct {
+	Total        int            `json:"total"`
+	StatusCounts map[string]int `json:"statusCounts"`
+	Duration     int64          `json:"durationInNanoSeconds"`
+}
+
+// Types of the reports, as in the AWS CodeBuild
+const (
+	ReportTest         = "TEST"
+	ReportCodeCoverage = "CODE_COVERAGE"
+)
+
+// Report holds test cases or code coverage collected from the files of a
+// report group
+type Report struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Format string   `json:"fileFormat"`
+	Status string   `json:"status"`
+	Files  []string `json:"files"`
+
+	Summary   *TestSummary `json:"testSummary,omitempty"`
+	TestCases []TestCase   `json:"testCases,omitempty"`
+
+	CoverageSummary *CoverageSummary `json:"codeCoverageSummary,omitempty"`
+	CodeCoverages   []FileCoverage   `json:"codeCoverages,omitempty"`
+
+	// Error explains why the report is incomplete
+	Error string `json:"error,omitempty"`
+	// Violations lists coverage thresholds which have not been met
+	Violations []string `json:"thresholdViolations,omitempty"`
+}
+
+// CollectReports parses files of the report groups defined in the `reports`
+// section. Problems with the files do not fail the build, instead they make
+// the report incomplete. Code coverage is checked against the thresholds from
+// the localcb config, except for shards of the build fanout, which are checked
+// once their reports are merged.
+func (cb *CodeBuild) CollectReports() []Report {
+	names := []string{}
+	for name := range cb.Definition.Reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reports := []Report{}
+	for _, name := range names {
+		reports = append(reports, collectReport(name, cb.Definition.Reports[name], cb.Project.Source.Location))
+	}
+	if cb.Shard == 0 {
+		cb.Config.checkThresholds(reports)
+	}
+	return reports
+}
+
+func collectReport(name string, rg ReportGroup, workspace string) Report {
+	r := Report{
+		Name:   name,
+		Type:   ReportTest,
+		Format: rg.FileFormat,
+		Files:  []string{},
+	}
+	if len(r.Format) == 0 {
+		r.Format = FormatJUnit
+	}
+
+	parseTests, isTest := reportParsers[r.Format]
+	parseCoverage, isCoverage := coverageParsers[r.Format]
+	if isCoverage {
+		r.Type = ReportCodeCoverage
+	}
+	if !isTest && !isCoverage {
+		return r.incomplete("file-format %s is not supported by localcb", r.Format)
+	}
+
+	files, _, err := listFiles(workspace, rg.BaseDirectory, rg.Files, false)
+	if err != nil {
+		return r.incomplete("%s", err)
+	}
+	if len(files) == 0 {
+		return r.incomplete("no report files found for %s in %s", strings.Join(rg.Files, ", "), filepath.Join(workspace, rg.BaseDirectory))
+	}
+
+	coverage := []FileCoverage{}
+	for _, f := range files {
+		file := filepath.ToSlash(filepath.Join(rg.BaseDirectory, f))
+		r.Files = append(r.Files, file)
+
+		contents, err := ioutil.ReadFile(filepath.Join(workspace, rg.BaseDirectory, f))
+		if err != nil {
+			return r.incomplete("%s", err)
+		}
+
+		if isCoverage {
+			fc, err := parseCoverage(contents)
+			if err != nil {
+				return r.incomplete("cannot parse %s as %s: %s", f, r.Format, err)
+			}
+			coverage = append(coverage, fc...)
+			continue
+		}
+
+		cases, err := parseTests(contents)
+		if err != nil {
+			return r.incomplete("cannot parse %s as %s: %s", f, r.Format, err)
+		}
+		for _, tc := range cases {
+			tc.File = file
+			r.TestCases = append(r.TestCases, tc)
+		}
+	}
+
+	r.Status = ReportSucceeded
+	if isCoverage {
+		r.CodeCoverages = mergeFileCoverages(coverage)
+		r.CoverageSummary = summarizeCoverage(r.CodeCoverages)
+		return r
+	}
+
+	r.Summary = summarizeTests(r.TestCases)
+	if r.Summary.StatusCounts[TestFailed]+r.Summary.StatusCounts[TestError] > 0 {
+		r.Status = ReportFailed
+	}
+	return r
+}
+
+func (r Report) incomplete(format string, args ...interface{}) Report {
+	r.Status = ReportIncomplete
+	r.Error = fmt.Sprintf(format, args...)
+	if r.Type == ReportTest {
+		r.Summary = summarizeTests(r.TestCases)
+	}
+	return r
+}
+
+func summarizeTests(cases []TestCase) *TestSummary {
+	s := &TestSummary{StatusCounts: map[string]int{}}
+	for _, tc := range cases {
+		s.Total++
+		s.StatusCounts[tc.Status]++
+		s.Duration += tc.Duration
+	}
+	return s
+}
+
+// Print writes a summary of the report: counts of the tests, the slowest
+// tests and messages of the failed ones or the code coverage.
+func (r Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "  Report %s (%s): %s\n", r.Name, r.Format, r.Status)
+	if len(r.Error) > 0 {
+		fmt.Fprintf(w, "    %s\n", r.Error)
+	}
+	if r.Type == ReportCodeCoverage {
+		r.printCoverage(w)
+		return
+	}
+	if r.Summary == nil || r.Summary.Total == 0 {
+		return
+	}
+
+	counts := []string{}
+	for _, status := range []string{TestSucceeded, TestFailed, TestError, TestSkipped, TestUnknown} {
+		if n := r.Summary.StatusCounts[status]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, strings.ToLower(status)))
+		}
+	}
+	fmt.Fprintf(w, "    %d test(s): %s in %s\n", r.Summary.Total, strings.Join(counts, ", "), formatDuration(r.Summary.Duration))
+
+	slowest := append([]TestCase{}, r.TestCases...)
+	sort.SliceStable(slowest, func(i, j int) bool { return slowest[i].Duration > slowest[j].Duration })
+	if len(slowest) > slowestTests {
+		slowest = slowest[:slowestTests]
+	}
+	fmt.Fprintf(w, "    Slowest:\n")
+	for _, tc := range slowest {
+		fmt.Fprintf(w, "      %8s  %s\n", formatDuration(tc.Duration), tc.FullName())
+	}
+
+	failed := false
+	for _, tc := range r.TestCases {
+		if tc.Status != TestFailed && tc.Status != TestError {
+			continue
+		}
+		if !failed {
+			fmt.Fprintf(w, "    Failures:\n")
+			failed = true
+		}
+		fmt.Fprintf(w, "      %s %s (%s)\n", tc.Status, tc.FullName(), tc.File)
+		if msg := firstLine(tc.Message); len(msg) > 0 {
+			fmt.Fprintf(w, "        %s\n", msg)
+		}
+	}
+}
+
+// SaveReports writes the reports, in the normalized form, to a JSON file
+func SaveReports(location string, reports []Report) error {
+	return saveJSON(location, reports)
+}
+
+func formatDuration(ns int64) string {
+	return time.Duration(ns).Round(time.Millisecond).String()
+}
+
+// firstLine returns the first non-empty line of the text
+func firstLine(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			return line
+		}
+	}
+	return ""
+}
+
+// secondsToNanos converts a duration given in (fractional) seconds
+func secondsToNanos(s string) int64 {
+	var seconds float64
+	fmt.Sscanf(strings.Replace(s, ",", "", -1), "%g", &seconds)
+	return int64(seconds * float64(time.Second))
+}
+
+// xmlNode is a generic XML element, report formats are read by walking them
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Text    string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+func parseXML(contents []byte) (xmlNode, error) {
+	var root xmlNode
+	err := xml.Unmarshal(contents, &root)
+	return root, err
+}
+
+// Attr returns value of the attribute (empty if missing)
+func (n xmlNode) Attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Child returns the first child element with the given name
+func (n xmlNode) Child(name string) (xmlNode, bool) {
+	for _, c := range n.Nodes {
+		if c.XMLName.Local == name {
+			return c, true
+		}
+	}
+	return xmlNode{}, false
+}
+
+// message returns the message attribute or the text of the element (or of its
+// message child element), whichever is given.
+func (n xmlNode) message() string {
+	if m := n.Attr("message"); len(m) > 0 {
+		return strings.TrimSpace(m + "\n" + n.Text)
+	}
+	if m, ok := n.Child("message"); ok {
+		return strings.TrimSpace(m.Text)
+	}
+	return strings.TrimSpace(n.Text)
+}
@@ -0,0 +1,53 @@
+package codebuild
+
+import (
+	"fmt"
+)
+
+// parseClover reads coverage of the Clover XML report from the metrics of the
+// files, where statements are counted as lines and conditionals as branches.
+func parseClover(contents []byte) ([]FileCoverage, error) {
+	root, err := parseXML(contents)
+	if err != nil {
+		return nil, err
+	}
+	if root.XMLName.Local != "coverage" {
+		return nil, fmt.Errorf("unexpected root element <%s>", root.XMLName.Local)
+	}
+
+	coverages := []FileCoverage{}
+	var walk func(n xmlNode)
+	walk = func(n xmlNode) {
+		if n.XMLName.Local == "file" {
+			coverages = append(coverages, cloverFileCoverage(n))
+			return
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	return coverages, nil
+}
+
+func cloverFileCoverage(n xmlNode) FileCoverage {
+	fc := FileCoverage{FilePath: n.Attr("path")}
+	if len(fc.FilePath) == 0 {
+		fc.FilePath = n.Attr("name")
+	}
+
+	if m, ok := n.Child("metrics"); ok {
+		var statements, coveredStatements, conditionals, coveredConditionals int
+		fmt.Sscanf(m.Attr("statements"), "%d", &statements)
+		fmt.Sscanf(m.Attr("coveredstatements"), "%d", &coveredStatements)
+		fmt.Sscanf(m.Attr("conditionals"), "%d", &conditionals)
+		fmt.Sscanf(m.Attr("coveredconditionals"), "%d", &coveredConditionals)
+
+		fc.LinesCovered, fc.LinesMissed = coveredStatements, statements-coveredStatements
+		fc.BranchesCovered, fc.BranchesMissed = coveredConditionals, conditionals-coveredConditionals
+	}
+	fc.computePercentages()
+
+	return fc
+}
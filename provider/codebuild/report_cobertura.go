@@ -0,0 +1,99 @@
+package codebuild
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// coberturaLine is a coverage of a single line, lines may be listed by many
+// classes of the same file.
+type coberturaLine struct {
+	hits            int
+	branchesCovered int
+	branchesTotal   int
+}
+
+// parseCobertura reads coverage of the Cobertura XML report. Lines are taken
+// from the classes (not their methods) and merged by the file name.
+func parseCobertura(contents []byte) ([]FileCoverage, error) {
+	root, err := parseXML(contents)
+	if err != nil {
+		return nil, err
+	}
+	if root.XMLName.Local != "coverage" {
+		return nil, fmt.Errorf("unexpected root element <%s>", root.XMLName.Local)
+	}
+
+	files := map[string]map[string]coberturaLine{}
+	var walk func(n xmlNode)
+	walk = func(n xmlNode) {
+		if n.XMLName.Local != "class" {
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+			return
+		}
+
+		name := n.Attr("filename")
+		if files[name] == nil {
+			files[name] = map[string]coberturaLine{}
+		}
+		lines, _ := n.Child("lines")
+		for _, l := range lines.Nodes {
+			if l.XMLName.Local != "line" {
+				continue
+			}
+			files[name][l.Attr("number")] = mergeCoberturaLine(files[name][l.Attr("number")], l)
+		}
+	}
+	walk(root)
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	coverages := []FileCoverage{}
+	for _, name := range names {
+		fc := FileCoverage{FilePath: name}
+		for _, l := range files[name] {
+			if l.hits > 0 {
+				fc.LinesCovered++
+			} else {
+				fc.LinesMissed++
+			}
+			fc.BranchesCovered += l.branchesCovered
+			fc.BranchesMissed += l.branchesTotal - l.branchesCovered
+		}
+		fc.computePercentages()
+		coverages = append(coverages, fc)
+	}
+	return coverages, nil
+}
+
+func mergeCoberturaLine(l coberturaLine, n xmlNode) coberturaLine {
+	var hits int
+	fmt.Sscanf(n.Attr("hits"), "%d", &hits)
+	if hits > l.hits {
+		l.hits = hits
+	}
+
+	// condition-coverage="50% (1/2)"
+	if n.Attr("branch") == "true" {
+		var covered, total int
+		cc := n.Attr("condition-coverage")
+		if i := strings.Index(cc, "("); i >= 0 {
+			fmt.Sscanf(cc[i:], "(%d/%d)", &covered, &total)
+		}
+		if covered > l.branchesCovered {
+			l.branchesCovered = covered
+		}
+		if total > l.branchesTotal {
+			l.branchesTotal = total
+		}
+	}
+
+	return l
+}
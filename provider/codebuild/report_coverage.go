@@ -0,0 +1,146 @@
+package codebuild
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Formats of the code coverage reports supported by the localcb
+const (
+	FormatClover    = "CLOVERXML"
+	FormatCobertura = "COBERTURAXML"
+	FormatJaCoCo    = "JACOCOXML"
+	FormatSimpleCov = "SIMPLECOV"
+)
+
+// coverageParser reads coverage of the source files from the contents of a
+// single report file
+type coverageParser func(contents []byte) ([]FileCoverage, error)
+
+var coverageParsers = map[string]coverageParser{
+	FormatClover:    parseClover,
+	FormatCobertura: parseCobertura,
+	FormatJaCoCo:    parseJaCoCo,
+	FormatSimpleCov: parseSimpleCov,
+}
+
+// CoverageSummary counts covered and missed lines and branches
+type CoverageSummary struct {
+	LineCoveragePercentage   float64 `json:"lineCoveragePercentage"`
+	LinesCovered             int     `json:"linesCovered"`
+	LinesMissed              int     `json:"linesMissed"`
+	BranchCoveragePercentage float64 `json:"branchCoveragePercentage"`
+	BranchesCovered          int     `json:"branchesCovered"`
+	BranchesMissed           int     `json:"branchesMissed"`
+}
+
+// FileCoverage is a coverage of a single source file
+type FileCoverage struct {
+	FilePath string `json:"filePath"`
+	CoverageSummary
+}
+
+// computePercentages fills percentages based on the counts. Code without any
+// lines or branches is considered as fully covered.
+func (cs *CoverageSummary) computePercentages() {
+	cs.LineCoveragePercentage = percentage(cs.LinesCovered, cs.LinesMissed)
+	cs.BranchCoveragePercentage = percentage(cs.BranchesCovered, cs.BranchesMissed)
+}
+
+func percentage(covered, missed int) float64 {
+	if covered+missed == 0 {
+		return 100
+	}
+
+	return float64(covered) * 100 / float64(covered+missed)
+}
+
+// mergeFileCoverages combines coverage of the same file found in many report
+// files. Only counts are known, so the best coverage of the file is taken
+// instead of a union of the covered lines.
+func mergeFileCoverages(coverages []FileCoverage) []FileCoverage {
+	byPath := map[string]*FileCoverage{}
+	paths := []string{}
+	for i := range coverages {
+		fc := coverages[i]
+		existing, ok := byPath[fc.FilePath]
+		if !ok {
+			byPath[fc.FilePath] = &fc
+			paths = append(paths, fc.FilePath)
+			continue
+		}
+
+		if fc.LinesCovered > existing.LinesCovered {
+			existing.LinesCovered, existing.LinesMissed = fc.LinesCovered, fc.LinesMissed
+		}
+		if fc.BranchesCovered > existing.BranchesCovered {
+			existing.BranchesCovered, existing.BranchesMissed = fc.BranchesCovered, fc.BranchesMissed
+		}
+	}
+	sort.Strings(paths)
+
+	merged := []FileCoverage{}
+	for _, p := range paths {
+		fc := byPath[p]
+		fc.computePercentages()
+		merged = append(merged, *fc)
+	}
+	return merged
+}
+
+func summarizeCoverage(coverages []FileCoverage) *CoverageSummary {
+	cs := &CoverageSummary{}
+	for _, fc := range coverages {
+		cs.LinesCovered += fc.LinesCovered
+		cs.LinesMissed += fc.LinesMissed
+		cs.BranchesCovered += fc.BranchesCovered
+		cs.BranchesMissed += fc.BranchesMissed
+	}
+	cs.computePercentages()
+	return cs
+}
+
+// checkCoverage marks the report as failed when its coverage is below the
+// threshold or when there is no coverage to check.
+func (r *Report) checkCoverage(t CoverageThreshold) {
+	if r.CoverageSummary == nil {
+		r.Violations = append(r.Violations, "no code coverage found to check the thresholds")
+	} else {
+		cs := r.CoverageSummary
+		if t.Line > 0 && cs.LineCoveragePercentage < t.Line {
+			r.Violations = append(r.Violations, fmt.Sprintf("line coverage %.2f%% is below %.2f%%", cs.LineCoveragePercentage, t.Line))
+		}
+		if t.Branch > 0 && cs.BranchCoveragePercentage < t.Branch {
+			r.Violations = append(r.Violations, fmt.Sprintf("branch coverage %.2f%% is below %.2f%%", cs.BranchCoveragePercentage, t.Branch))
+		}
+	}
+
+	if len(r.Violations) > 0 {
+		r.Status = ReportFailed
+	}
+}
+
+func (r Report) printCoverage(w io.Writer) {
+	if cs := r.CoverageSummary; cs != nil {
+		fmt.Fprintf(w, "    Line coverage: %.2f%% (%d of %d lines)\n",
+			cs.LineCoveragePercentage, cs.LinesCovered, cs.LinesCovered+cs.LinesMissed)
+		fmt.Fprintf(w, "    Branch coverage: %.2f%% (%d of %d branches)\n",
+			cs.BranchCoveragePercentage, cs.BranchesCovered, cs.BranchesCovered+cs.BranchesMissed)
+	}
+	for _, v := range r.Violations {
+		fmt.Fprintf(w, "    Threshold not met: %s\n", v)
+	}
+}
+
+// CoverageViolations returns names of the report groups which have not met
+// their coverage thresholds.
+func CoverageViolations(reports []Report) []string {
+	names := []string{}
+	for _, r := range reports {
+		if len(r.Violations) > 0 {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
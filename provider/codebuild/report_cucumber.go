@@ -0,0 +1,62 @@
+package codebuild
+
+import "encoding/json"
+
+// cucumberFeature is a feature of the Cucumber JSON report
+type cucumberFeature struct {
+	Name     string `json:"name"`
+	URI      string `json:"uri"`
+	Elements []struct {
+		Name  string `json:"name"`
+		Type  string `json:"type"`
+		Steps []struct {
+			Name   string `json:"name"`
+			Result struct {
+				Status       string `json:"status"`
+				Duration     int64  `json:"duration"`
+				ErrorMessage string `json:"error_message"`
+			} `json:"result"`
+		} `json:"steps"`
+	} `json:"elements"`
+}
+
+// parseCucumber reads scenarios of the Cucumber JSON report as test cases.
+// A scenario fails when any of its steps fails.
+func parseCucumber(contents []byte) ([]TestCase, error) {
+	features := []cucumberFeature{}
+	if err := json.Unmarshal(contents, &features); err != nil {
+		return nil, err
+	}
+
+	cases := []TestCase{}
+	for _, f := range features {
+		for _, e := range f.Elements {
+			if e.Type == "background" {
+				continue
+			}
+
+			tc := TestCase{Prefix: f.Name, Name: e.Name, Status: TestSucceeded}
+			for _, s := range e.Steps {
+				tc.Duration += s.Result.Duration
+
+				switch s.Result.Status {
+				case "passed":
+				case "failed":
+					tc.Status = TestFailed
+					tc.Message = s.Name + ": " + s.Result.ErrorMessage
+				case "skipped", "pending":
+					if tc.Status == TestSucceeded {
+						tc.Status = TestSkipped
+					}
+				default:
+					if tc.Status == TestSucceeded {
+						tc.Status = TestUnknown
+					}
+				}
+			}
+			cases = append(cases, tc)
+		}
+	}
+
+	return cases, nil
+}
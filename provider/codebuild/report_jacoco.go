@@ -0,0 +1,59 @@
+package codebuild
+
+import (
+	"fmt"
+	"path"
+)
+
+// parseJaCoCo reads coverage of the JaCoCo XML report from the LINE and
+// BRANCH counters of the source files. Paths of the files are relative to the
+// source roots, i.e. com/example/App.java.
+func parseJaCoCo(contents []byte) ([]FileCoverage, error) {
+	root, err := parseXML(contents)
+	if err != nil {
+		return nil, err
+	}
+	if root.XMLName.Local != "report" {
+		return nil, fmt.Errorf("unexpected root element <%s>", root.XMLName.Local)
+	}
+
+	coverages := []FileCoverage{}
+	var walk func(n xmlNode, pkg string)
+	walk = func(n xmlNode, pkg string) {
+		switch n.XMLName.Local {
+		case "package":
+			pkg = n.Attr("name")
+		case "sourcefile":
+			coverages = append(coverages, jacocoFileCoverage(n, pkg))
+			return
+		}
+		for _, c := range n.Nodes {
+			walk(c, pkg)
+		}
+	}
+	walk(root, "")
+
+	return coverages, nil
+}
+
+func jacocoFileCoverage(n xmlNode, pkg string) FileCoverage {
+	fc := FileCoverage{FilePath: path.Join(pkg, n.Attr("name"))}
+	for _, c := range n.Nodes {
+		if c.XMLName.Local != "counter" {
+			continue
+		}
+
+		var missed, covered int
+		fmt.Sscanf(c.Attr("missed"), "%d", &missed)
+		fmt.Sscanf(c.Attr("covered"), "%d", &covered)
+		switch c.Attr("type") {
+		case "LINE":
+			fc.LinesCovered, fc.LinesMissed = covered, missed
+		case "BRANCH":
+			fc.BranchesCovered, fc.BranchesMissed = covered, missed
+		}
+	}
+	fc.computePercentages()
+
+	return fc
+}
@@ -0,0 +1,57 @@
+package codebuild
+
+// parseJUnit reads test cases of the JUnit XML report, where test suites
+// (optionally grouped in <testsuites>) may be nested.
+func parseJUnit(contents []byte) ([]TestCase, error) {
+	root, err := parseXML(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	cases := []TestCase{}
+	var walk func(n xmlNode, suite string)
+	walk = func(n xmlNode, suite string) {
+		switch n.XMLName.Local {
+		case "testcase":
+			cases = append(cases, junitTestCase(n, suite))
+			return
+		case "testsuite":
+			suite = n.Attr("name")
+		}
+		for _, c := range n.Nodes {
+			walk(c, suite)
+		}
+	}
+	walk(root, "")
+
+	return cases, nil
+}
+
+func junitTestCase(n xmlNode, suite string) TestCase {
+	tc := TestCase{
+		Prefix:   n.Attr("classname"),
+		Name:     n.Attr("name"),
+		Status:   TestSucceeded,
+		Duration: secondsToNanos(n.Attr("time")),
+	}
+	if len(tc.Prefix) == 0 {
+		tc.Prefix = suite
+	}
+
+	// The first failure, error or skipped element decides the status
+	for _, c := range n.Nodes {
+		switch c.XMLName.Local {
+		case "failure":
+			tc.Status, tc.Message = TestFailed, c.message()
+			return tc
+		case "error":
+			tc.Status, tc.Message = TestError, c.message()
+			return tc
+		case "skipped":
+			tc.Status, tc.Message = TestSkipped, c.message()
+			return tc
+		}
+	}
+
+	return tc
+}
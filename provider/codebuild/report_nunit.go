@@ -0,0 +1,101 @@
+package codebuild
+
+// parseNUnit reads test cases of the NUnit 2 XML report
+func parseNUnit(contents []byte) ([]TestCase, error) {
+	root, err := parseXML(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	cases := []TestCase{}
+	for _, n := range findTestCases(root) {
+		tc := TestCase{
+			Name:     n.Attr("name"),
+			Duration: secondsToNanos(n.Attr("time")),
+		}
+
+		switch n.Attr("result") {
+		case "Success":
+			tc.Status = TestSucceeded
+		case "Failure":
+			tc.Status = TestFailed
+		case "Error", "NotRunnable", "Cancelled":
+			tc.Status = TestError
+		case "Ignored", "Skipped":
+			tc.Status = TestSkipped
+		case "":
+			tc.Status = TestUnknown
+			if n.Attr("executed") == "False" {
+				tc.Status = TestSkipped
+			}
+		default:
+			tc.Status = TestUnknown
+		}
+
+		tc.Message = nunitMessage(n)
+		cases = append(cases, tc)
+	}
+
+	return cases, nil
+}
+
+// parseNUnit3 reads test cases of the NUnit 3 XML report
+func parseNUnit3(contents []byte) ([]TestCase, error) {
+	root, err := parseXML(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	cases := []TestCase{}
+	for _, n := range findTestCases(root) {
+		tc := TestCase{
+			Prefix:   n.Attr("classname"),
+			Name:     n.Attr("name"),
+			Duration: secondsToNanos(n.Attr("duration")),
+		}
+
+		switch n.Attr("result") {
+		case "Passed", "Warning":
+			tc.Status = TestSucceeded
+		case "Failed":
+			tc.Status = TestFailed
+			switch n.Attr("label") {
+			case "Error", "Invalid", "Cancelled":
+				tc.Status = TestError
+			}
+		case "Skipped":
+			tc.Status = TestSkipped
+		default:
+			tc.Status = TestUnknown
+		}
+
+		tc.Message = nunitMessage(n)
+		cases = append(cases, tc)
+	}
+
+	return cases, nil
+}
+
+// findTestCases returns all <test-case> elements, which in NUnit reports are
+// nested in any number of <test-suite> elements.
+func findTestCases(n xmlNode) []xmlNode {
+	if n.XMLName.Local == "test-case" {
+		return []xmlNode{n}
+	}
+
+	cases := []xmlNode{}
+	for _, c := range n.Nodes {
+		cases = append(cases, findTestCases(c)...)
+	}
+	return cases
+}
+
+// nunitMessage returns message of the failure or a reason of skipping the test
+func nunitMessage(n xmlNode) string {
+	for _, name := range []string{"failure", "reason"} {
+		if c, ok := n.Child(name); ok {
+			return c.message()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package codebuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// simpleCovFile is coverage of a single file, either an array of hits per
+// line (older SimpleCov) or an object with lines and branches. Hits are null
+// for irrelevant lines and "ignored" for lines skipped by nocov.
+type simpleCovFile struct {
+	Lines    []interface{}             `json:"lines"`
+	Branches map[string]map[string]int `json:"branches"`
+}
+
+func (f *simpleCovFile) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &f.Lines); err == nil {
+		return nil
+	}
+
+	type plain simpleCovFile
+	return json.Unmarshal(data, (*plain)(f))
+}
+
+// parseSimpleCov reads coverage of the SimpleCov JSON report, either the
+// .resultset.json of SimpleCov or the coverage.json of simplecov-json.
+// Results of many commands are merged by the file name.
+func parseSimpleCov(contents []byte) ([]FileCoverage, error) {
+	files, err := simpleCovFiles(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	coverages := []FileCoverage{}
+	for _, name := range names {
+		fc := FileCoverage{FilePath: name}
+		for i, f := range files[name] {
+			c := simpleCovFileCoverage(name, f)
+			if i == 0 || c.LinesCovered > fc.LinesCovered {
+				fc.LinesCovered, fc.LinesMissed = c.LinesCovered, c.LinesMissed
+			}
+			if i == 0 || c.BranchesCovered > fc.BranchesCovered {
+				fc.BranchesCovered, fc.BranchesMissed = c.BranchesCovered, c.BranchesMissed
+			}
+		}
+		fc.computePercentages()
+		coverages = append(coverages, fc)
+	}
+	return coverages, nil
+}
+
+func simpleCovFiles(contents []byte) (map[string][]simpleCovFile, error) {
+	files := map[string][]simpleCovFile{}
+
+	// coverage.json: {"files": [{"filename": ..., "coverage": ...}]}
+	var report struct {
+		Files []struct {
+			Filename string        `json:"filename"`
+			Coverage simpleCovFile `json:"coverage"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(contents, &report); err == nil && len(report.Files) > 0 {
+		for _, f := range report.Files {
+			files[f.Filename] = append(files[f.Filename], f.Coverage)
+		}
+		return files, nil
+	}
+
+	// .resultset.json: {"<command>": {"coverage": {"<file>": ...}}}
+	var resultset map[string]struct {
+		Coverage map[string]simpleCovFile `json:"coverage"`
+	}
+	if err := json.Unmarshal(contents, &resultset); err != nil {
+		return nil, fmt.Errorf("neither coverage.json nor .resultset.json: %s", err)
+	}
+	for _, result := range resultset {
+		for name, f := range result.Coverage {
+			files[name] = append(files[name], f)
+		}
+	}
+	return files, nil
+}
+
+func simpleCovFileCoverage(name string, f simpleCovFile) FileCoverage {
+	fc := FileCoverage{FilePath: name}
+	for _, line := range f.Lines {
+		hits, ok := line.(float64)
+		switch {
+		case !ok:
+			// line is not relevant (i.e. a comment) or ignored
+		case hits > 0:
+			fc.LinesCovered++
+		default:
+			fc.LinesMissed++
+		}
+	}
+
+	for _, branches := range f.Branches {
+		for _, hits := range branches {
+			if hits > 0 {
+				fc.BranchesCovered++
+			} else {
+				fc.BranchesMissed++
+			}
+		}
+	}
+
+	return fc
+}
@@ -0,0 +1,61 @@
+package codebuild
+
+import "strconv"
+
+// parseTestNG reads test methods of the TestNG XML report, configuration
+// methods (i.e. @BeforeClass) are left out.
+func parseTestNG(contents []byte) ([]TestCase, error) {
+	root, err := parseXML(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	cases := []TestCase{}
+	var walk func(n xmlNode, class string)
+	walk = func(n xmlNode, class string) {
+		switch n.XMLName.Local {
+		case "test-method":
+			if n.Attr("is-config") != "true" {
+				cases = append(cases, testNGTestCase(n, class))
+			}
+			return
+		case "class":
+			class = n.Attr("name")
+		}
+		for _, c := range n.Nodes {
+			walk(c, class)
+		}
+	}
+	walk(root, "")
+
+	return cases, nil
+}
+
+func testNGTestCase(n xmlNode, class string) TestCase {
+	ms, _ := strconv.ParseInt(n.Attr("duration-ms"), 10, 64)
+	tc := TestCase{
+		Prefix:   class,
+		Name:     n.Attr("name"),
+		Duration: ms * 1000000,
+	}
+
+	switch n.Attr("status") {
+	case "PASS":
+		tc.Status = TestSucceeded
+	case "FAIL":
+		tc.Status = TestFailed
+	case "SKIP":
+		tc.Status = TestSkipped
+	default:
+		tc.Status = TestUnknown
+	}
+
+	if exception, ok := n.Child("exception"); ok {
+		tc.Message = exception.message()
+		if len(tc.Message) == 0 {
+			tc.Message = exception.Attr("class")
+		}
+	}
+
+	return tc
+}
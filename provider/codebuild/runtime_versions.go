@@ -0,0 +1,119 @@
+package codebuild
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// RuntimeCommands returns commands which select runtimes requested in the
+// `runtime-versions` of the install phase, the same way as they are selected
+// by the CodeBuild in its standard images.
+func (cb *CodeBuild) RuntimeCommands() ([]string, error) {
+	requested := cb.Definition.Phases.Install.RuntimeVersions
+	if len(requested) == 0 {
+		return nil, nil
+	}
+
+	image := cb.Project.Environment.Image
+	runtimes, ok := standardRuntimes[strings.TrimPrefix(image, "aws/codebuild/")]
+	if !ok {
+		return nil, fmt.Errorf("image %s does not support runtime-versions, use one of the standard images instead", image)
+	}
+
+	names := []string{}
+	for name := range requested {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	commands := []string{}
+	for _, name := range names {
+		versions, ok := runtimes[name]
+		if !ok {
+			return nil, fmt.Errorf("image %s does not provide %s runtime", image, name)
+		}
+
+		version, ok := selectRuntimeVersion(versions, requested[name])
+		if !ok {
+			return nil, fmt.Errorf("image %s does not provide %s runtime in version %s (available: %s)",
+				image, name, requested[name], strings.Join(versions, ", "))
+		}
+
+		commands = append(commands, fmt.Sprintf(`echo "Installing %s version %s ..."`, name, version))
+		if cmd := runtimeSelector(name, version); cmd != "" {
+			commands = append(commands, cmd)
+		}
+	}
+
+	return commands, nil
+}
+
+// parseRuntimeVersions reads `runtime-versions` of the install phase as they
+// are written in the buildspec. Parsed as numbers, versions like 3.0 or 1.10
+// would become 3 and 1.1.
+func parseRuntimeVersions(contents []byte) (map[string]string, error) {
+	var raw struct {
+		Phases struct {
+			Install struct {
+				RuntimeVersions map[string]yaml.Node `yaml:"runtime-versions"`
+			} `yaml:"install"`
+		} `yaml:"phases"`
+	}
+	if err := yaml.Unmarshal(contents, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Phases.Install.RuntimeVersions == nil {
+		return nil, nil
+	}
+
+	versions := map[string]string{}
+	for name, node := range raw.Phases.Install.RuntimeVersions {
+		versions[name] = node.Value
+	}
+	return versions, nil
+}
+
+// selectRuntimeVersion looks for the requested version in versions provided
+// by the image. The `latest` alias resolves to the newest one. Trailing .0 is
+// not significant, so 3 selects 3.0.
+func selectRuntimeVersion(versions []string, requested string) (string, bool) {
+	if requested == "latest" {
+		return versions[len(versions)-1], true
+	}
+
+	for _, v := range versions {
+		if v == requested || strings.TrimSuffix(v, ".0") == strings.TrimSuffix(requested, ".0") {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// runtimeSelector returns command which switches the runtime to given version.
+// It relies on the version managers and env variables defined in the images.
+// An empty string is returned for runtimes which are installed side by side.
+func runtimeSelector(runtime, version string) string {
+	digits := strings.Replace(version, ".", "", -1)
+
+	switch runtime {
+	case "golang":
+		return "goenv global $GOLANG_" + strings.Replace(strings.TrimPrefix(version, "1."), ".", "", -1) + "_VERSION"
+	case "nodejs":
+		return "n $NODE_" + digits + "_VERSION"
+	case "python":
+		return "pyenv global $PYTHON_" + digits + "_VERSION"
+	case "ruby":
+		return "rbenv global $RUBY_" + digits + "_VERSION"
+	case "php":
+		return "phpenv global $PHP_" + digits + "_VERSION"
+	case "java":
+		release := strings.TrimLeft(version, "abcdefghijklmnopqrstuvwxyz")
+		return `export JAVA_HOME="$JAVA_` + release + `_HOME" PATH="$JAVA_` + release + `_HOME/bin:$PATH"`
+	}
+
+	return ""
+}
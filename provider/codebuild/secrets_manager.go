@@ -0,0 +1,238 @@
+package codebuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sanathkr/yaml"
+)
+
+const defaultVersionStage = "AWSCURRENT"
+
+// defaultSecretsManagerFiles are looked up in the project directory when the
+// location of the local secrets file has not been given.
+var defaultSecretsManagerFiles = []string{
+	"localcb-secrets.yml",
+	"localcb-secrets.yaml",
+	"localcb-secrets.json",
+}
+
+// versionID matches version ids of the secrets, which are UUIDs
+var versionID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// arnSuffix matches the random suffix, which the Secrets Manager appends to
+// the name of the secret in its ARN
+var arnSuffix = regexp.MustCompile(`-[A-Za-z0-9]{6}$`)
+
+// SecretsManager is a local, file-backed stand-in for the AWS Secrets Manager.
+// Each secret is either a plain value of its AWSCURRENT version, or a map of
+// versions (version stages, including custom ones, or version ids) to values.
+// A version is either a value or a map with the SecretString. JSON secrets
+// might be written as objects, i.e.:
+//
+//	api-token: abc123
+//	db-credentials:
+//	  AWSCURRENT: {"username": "admin", "password": "s3cr3t"}
+//	  AWSPREVIOUS: {"username": "admin", "password": "0ld"}
+//	  PROD: {SecretString: '{"username": "admin", "password": "pr0d"}'}
+//	db: {"username": "admin", "password": "s3cr3t"}
+type SecretsManager struct {
+	Location string
+	Secrets  map[string]interface{}
+}
+
+// LoadSecretsManager reads the local secrets from a YAML or JSON file.
+func LoadSecretsManager(location, baseDir string) (SecretsManager, error) {
+	location = findLocalFile(location, baseDir, defaultSecretsManagerFiles)
+
+	sm := SecretsManager{Location: location}
+	if location == "" {
+		return sm, nil
+	}
+
+	contents, err := ioutil.ReadFile(location)
+	if err != nil {
+		return sm, err
+	}
+
+	err = yaml.Unmarshal(contents, &sm.Secrets)
+	if err != nil {
+		return sm, fmt.Errorf("cannot parse local secrets %s: %s", location, err)
+	}
+
+	return sm, nil
+}
+
+// Resolve looks up secrets referenced in the `secrets-manager` section of the
+// buildspec and returns them as key=value env variables.
+func (sm SecretsManager) Resolve(refs map[string]string) ([]string, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if sm.Location == "" {
+		return nil, fmt.Errorf("buildspec uses env.secrets-manager, but there are no local secrets (use --secrets-file or create %s)", defaultSecretsManagerFiles[0])
+	}
+
+	names := []string{}
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := []string{}
+	for _, name := range names {
+		ref, err := ParseSecretReference(refs[name])
+		if err != nil {
+			return nil, fmt.Errorf("env.secrets-manager.%s: %s", name, err)
+		}
+
+		value, err := sm.value(ref)
+		if err != nil {
+			return nil, fmt.Errorf("env.secrets-manager.%s: %s", name, err)
+		}
+		vars = append(vars, name+"="+value)
+	}
+
+	return vars, nil
+}
+
+func (sm SecretsManager) value(ref SecretReference) (string, error) {
+	secret, ok := sm.Secrets[ref.SecretID]
+	if !ok && strings.HasPrefix(ref.SecretID, "arn:") {
+		// Secrets might be stored under their names instead of ARNs, which
+		// end with the name and a random suffix
+		name := ref.SecretID[strings.LastIndex(ref.SecretID, ":")+1:]
+		secret, ok = sm.Secrets[name]
+		if !ok {
+			secret, ok = sm.Secrets[arnSuffix.ReplaceAllString(name, "")]
+		}
+	}
+	if !ok {
+		return "", fmt.Errorf("secret %s not found in %s", ref.SecretID, sm.Location)
+	}
+
+	version := ref.VersionStage
+	if ref.VersionID != "" {
+		version = ref.VersionID
+	}
+
+	var raw interface{}
+	switch s := secret.(type) {
+	case map[string]interface{}:
+		if isVersionMap(s) {
+			raw, ok = s[version]
+			if !ok {
+				return "", fmt.Errorf("secret %s has no version %s in %s", ref.SecretID, version, sm.Location)
+			}
+			if v, ok := raw.(map[string]interface{}); ok && v["SecretString"] != nil {
+				raw = v["SecretString"]
+			}
+			break
+		}
+		if version != defaultVersionStage {
+			return "", fmt.Errorf("secret %s has no version %s in %s", ref.SecretID, version, sm.Location)
+		}
+		raw = s
+	default:
+		if version != defaultVersionStage {
+			return "", fmt.Errorf("secret %s has no version %s in %s", ref.SecretID, version, sm.Location)
+		}
+		raw = s
+	}
+
+	value, err := secretString(raw)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %s", ref.SecretID, err)
+	}
+	if ref.JSONKey == "" {
+		return value, nil
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object, so json-key %s cannot be extracted", ref.SecretID, ref.JSONKey)
+	}
+	field, ok := fields[ref.JSONKey]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no json-key %s", ref.SecretID, ref.JSONKey)
+	}
+
+	return secretString(field)
+}
+
+// isVersionMap tells whether the map holds versions of the secret, rather
+// than a JSON object being the value of its AWSCURRENT version. It does when
+// any of its keys is an AWS* version stage or a version id, or any of its
+// values is a map with the SecretString; then all keys are versions.
+func isVersionMap(m map[string]interface{}) bool {
+	for key, value := range m {
+		if strings.HasPrefix(key, "AWS") || versionID.MatchString(key) {
+			return true
+		}
+		if v, ok := value.(map[string]interface{}); ok && v["SecretString"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// secretString formats value of the secret as it would be returned by the
+// Secrets Manager, where structured values are always JSON-encoded.
+func secretString(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// SecretReference describes value of the `secrets-manager` env variable in the
+// `secret-id:json-key:version-stage:version-id` format.
+type SecretReference struct {
+	SecretID     string
+	JSONKey      string
+	VersionStage string
+	VersionID    string
+}
+
+// ParseSecretReference parses reference to the secret. The secret-id is either
+// a name or an ARN (which itself contains colons), all remaining parts are
+// optional and version-stage defaults to AWSCURRENT. When version-id is given,
+// it takes precedence over the version-stage.
+func ParseSecretReference(ref string) (SecretReference, error) {
+	parts := strings.Split(ref, ":")
+
+	idParts := 1
+	if strings.HasPrefix(ref, "arn:") {
+		// arn:aws:secretsmanager:region:account-id:secret:name
+		idParts = 7
+		if len(parts) < idParts {
+			return SecretReference{}, fmt.Errorf("invalid secret ARN in reference %s", ref)
+		}
+	}
+
+	sr := SecretReference{SecretID: strings.Join(parts[:idParts], ":")}
+	rest := parts[idParts:]
+	if len(rest) > 3 {
+		return sr, fmt.Errorf("invalid secret reference %s, expected secret-id:json-key:version-stage:version-id", ref)
+	}
+	if sr.SecretID == "" {
+		return sr, fmt.Errorf("missing secret-id in reference %s", ref)
+	}
+
+	rest = append(rest, "", "", "")
+	sr.JSONKey = rest[0]
+	sr.VersionStage = rest[1]
+	sr.VersionID = rest[2]
+
+	if sr.VersionStage == "" {
+		sr.VersionStage = defaultVersionStage
+	}
+
+	return sr, nil
+}
@@ -4,47 +4,283 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"path"
+	"strings"
 
 	"github.com/piotrkubisa/localcb/ci"
 )
 
 // ShellScript transforms CodeBuild definition file to localcb.sh shell script
 type ShellScript struct {
-	Buffer *bytes.Buffer
+	Buffer   *bytes.Buffer
+	Strategy CommandStrategy
+
+	// Shell runs commands of the stages which are run as another user or
+	// in separate shell instances
+	Shell string
+
+	runAsDeclared bool
 }
 
 // NewShellScript creates new ShellScript with a brand new buffer
-func NewShellScript() *ShellScript {
+func NewShellScript(strategy CommandStrategy) *ShellScript {
 	return &ShellScript{
-		Buffer: new(bytes.Buffer),
+		Buffer:   new(bytes.Buffer),
+		Strategy: strategy,
+	}
+}
+
+// CommandStrategy decides how a single command is written to the script.
+// The onError is a shell built-in (return or exit) which is called with the
+// exit code of the command when it fails.
+type CommandStrategy func(sr *ShellScript, w io.Writer, cmd ci.Command, onError string)
+
+// NewCommandStrategy returns the CommandStrategy which mimics the behaviour
+// of the given buildspec version.
+func NewCommandStrategy(version string) (CommandStrategy, error) {
+	switch version {
+	case "0.1":
+		return SeparateShell, nil
+	case "0.2":
+		return SharedShell, nil
+	case "":
+		return nil, fmt.Errorf("missing buildspec version, expected 0.1 or 0.2")
+	}
+
+	return nil, fmt.Errorf("unknown buildspec version (%s), expected 0.1 or 0.2", version)
+}
+
+// SharedShell runs each command in a subshell, so exit fails only the command
+// itself. Env variables and the current directory are saved when the subshell
+// exits and restored before the next command, so they are carried over
+// (buildspec version 0.2). Commands run as another user are already in a
+// separate shell, which they share as is.
+func SharedShell(sr *ShellScript, w io.Writer, cmd ci.Command, onError string) {
+	if onError == "exit" {
+		io.WriteString(w, "{\n")
+		io.WriteString(w, cmd.Exec)
+		fmt.Fprintf(w, "\n} || %s $?\n", onError)
+		return
+	}
+
+	io.WriteString(w, "rm -f \"$localcb_state\"\n")
+	io.WriteString(w, "(\n")
+	fmt.Fprintf(w, saveStateTrap+"\n", `"$localcb_state"`)
+	io.WriteString(w, "set -a\n")
+	io.WriteString(w, cmd.Exec)
+	io.WriteString(w, "\n)\n")
+	io.WriteString(w, "localcb_cmd_status=$?\n")
+	io.WriteString(w, "if [ -f \"$localcb_state\" ]; then . \"$localcb_state\"; fi\n")
+	fmt.Fprintf(w, "[ $localcb_cmd_status -eq 0 ] || %s $localcb_cmd_status\n", onError)
+}
+
+// saveStateTrap writes env variables and the current directory of the shell
+// to the given file when the shell exits, whatever way it does. The exit code
+// is kept in a positional parameter, so it is not exported along with the
+// variables. Variables are exported by set -a, so not exported ones are saved
+// as well. Bash prints them with declare, which makes them local when the
+// file is sourced in a function, so they are declared as global instead.
+const saveStateTrap = `trap 'set -- $?; set +a; LOCALCB_PWD="$PWD"; export LOCALCB_PWD; { export -p | sed "s/^declare -\([^ ]*\) /declare -g\1 /"; echo "cd \"\$LOCALCB_PWD\""; } > %[1]s.tmp && mv %[1]s.tmp %[1]s; exit $1' EXIT`
+
+// SeparateShell runs each command in a separate shell instance, so changes of
+// env variables and the current directory are discarded after each command
+// (buildspec version 0.1).
+func SeparateShell(sr *ShellScript, w io.Writer, cmd ci.Command, onError string) {
+	fmt.Fprintf(w, "%s -c %s || %s $?\n", sr.Shell, shellQuote(cmd.Exec), onError)
+}
+
+// shellQuote wraps the text in single quotes, so it is passed to the shell
+// as is.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Begin writes variables which track the state of the build.
+// localcb_skip_to holds a name of the stage where the build resumes after a
+// failure ('-' means there is nothing left to run), localcb_state is a file
+// passing the state of the shell between commands. Helper commands, such as
+// codebuild-tests-run, are added to the PATH.
+func (sr *ShellScript) Begin() {
+	io.WriteString(sr.Buffer, "# Generated by localcb, do not edit\n")
+	fmt.Fprintf(sr.Buffer, "export PATH=\"$PATH:%s\"\n", guestBinDirectory)
+	io.WriteString(sr.Buffer, "localcb_failed=0\n")
+	io.WriteString(sr.Buffer, "localcb_skip_to=''\n")
+	io.WriteString(sr.Buffer, "localcb_state=\"${TMPDIR:-/tmp}/localcb-state.$$\"\n")
+	io.WriteString(sr.Buffer, "\n")
+}
+
+// End captures values of the exported variables and makes the script exit
+// with non-zero code if any of the stages failed. Variables are written as
+// NUL-separated key=value entries, unset variables are omitted.
+func (sr *ShellScript) End(exported []string) {
+	writeExportedVariables(sr.Buffer, exported)
+	io.WriteString(sr.Buffer, "rm -f \"$localcb_state\" \"$localcb_state.tmp\"\n")
+	io.WriteString(sr.Buffer, "exit $localcb_failed\n")
+}
+
+// writeExportedVariables captures values of the exported variables into the
+// exportedVariablesFile
+func writeExportedVariables(w io.Writer, exported []string) {
+	if len(exported) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "mkdir -p '%s'\n", guestStateDirectory)
+	fmt.Fprintf(w, ": > '%s'\n", exportedVariablesFile)
+	for _, name := range exported {
+		fmt.Fprintf(w, "if [ -n \"${%s+x}\" ]; then printf '%%s=%%s\\0' '%s' \"$%s\" >> '%s'; fi\n",
+			name, name, name, exportedVariablesFile)
+	}
+}
+
+// RestoreCache copies cached directories from the cacheDir to their locations
+// before the first stage. A missing or broken cache does not fail the build.
+func (sr *ShellScript) RestoreCache(cacheDir string, dirs []CachedDirectory) {
+	io.WriteString(sr.Buffer, "# ********************************\n")
+	io.WriteString(sr.Buffer, "# > Restoring cache\n")
+	io.WriteString(sr.Buffer, "# ---\n")
+	io.WriteString(sr.Buffer, "localcb_src_dir=\"$(pwd)\"\n")
+	for _, d := range dirs {
+		cached := shellQuote(path.Join(cacheDir, d.Key))
+		fmt.Fprintf(sr.Buffer, "if [ -d %s ]; then\n", cached)
+		fmt.Fprintf(sr.Buffer, "echo %s\n", shellQuote("[Container] Restoring cache of "+d.Path))
+		fmt.Fprintf(sr.Buffer, "mkdir -p %s && cp -a %s/. %s/ || echo %s >&2\n",
+			d.shellPath(), cached, d.shellPath(), shellQuote("[Container] Failed to restore cache of "+d.Path))
+		io.WriteString(sr.Buffer, "fi\n")
 	}
+	io.WriteString(sr.Buffer, "\n")
 }
 
+// SaveCache replaces cached copies of the directories in the cacheDir, but
+// only when all stages have succeeded.
+func (sr *ShellScript) SaveCache(cacheDir string, dirs []CachedDirectory) {
+	io.WriteString(sr.Buffer, "if [ $localcb_failed -eq 0 ]; then\n")
+	for _, d := range dirs {
+		cached := shellQuote(path.Join(cacheDir, d.Key))
+		fmt.Fprintf(sr.Buffer, "if [ -d %s ]; then\n", d.shellPath())
+		fmt.Fprintf(sr.Buffer, "echo %s\n", shellQuote("[Container] Saving cache of "+d.Path))
+		fmt.Fprintf(sr.Buffer, "rm -rf %s && mkdir -p %s && cp -a %s/. %s/ || echo %s >&2\n",
+			cached, cached, d.shellPath(), cached, shellQuote("[Container] Failed to save cache of "+d.Path))
+		io.WriteString(sr.Buffer, "fi\n")
+	}
+	io.WriteString(sr.Buffer, "fi\n")
+}
+
+// ExtractStage writes the stage as a pair of shell functions: one with the
+// stage commands and one with its finally commands. Both of them stop at the
+// first failing command, but the finally function is always called.
 func (sr *ShellScript) ExtractStage(stage *ci.Stage) error {
 	sr.enterStage(sr.Buffer, stage)
 
-	for _, cmd := range stage.Commands {
-		io.WriteString(sr.Buffer, cmd.Exec)
-		io.WriteString(sr.Buffer, "\n")
+	fmt.Fprintf(sr.Buffer, "if [ -z \"$localcb_skip_to\" ] || [ \"$localcb_skip_to\" = '%s' ]; then\n", stage.Name)
+	io.WriteString(sr.Buffer, "localcb_skip_to=''\n")
+	fmt.Fprintf(sr.Buffer, "echo '[Container] Entering phase %s'\n", strings.ToUpper(stage.Name))
+
+	if len(stage.User) > 0 && !sr.runAsDeclared {
+		sr.writeRunAs(sr.Buffer)
+	}
+
+	sr.writeFunction(sr.Buffer, "localcb_stage_"+stage.Name, stage.User, stage.Commands)
+	if len(stage.Finally) > 0 {
+		sr.writeFunction(sr.Buffer, "localcb_finally_"+stage.Name, stage.User, stage.Finally)
+	}
+
+	fmt.Fprintf(sr.Buffer, "localcb_stage_%s\n", stage.Name)
+	io.WriteString(sr.Buffer, "localcb_status=$?\n")
+	if len(stage.Finally) > 0 {
+		fmt.Fprintf(sr.Buffer, "localcb_finally_%s || [ $localcb_status -ne 0 ] || localcb_status=1\n", stage.Name)
 	}
 
+	sr.writeStatus(sr.Buffer, stage)
+	io.WriteString(sr.Buffer, "fi\n")
+
 	sr.exitStage(sr.Buffer, stage)
 	return nil
 }
 
+// writeFunction declares a shell function which runs given commands and
+// returns the exit code of the first one that failed. If user is given, the
+// commands are written to a file in the guestStateDirectory, which is passed
+// to the localcb_run_as function instead, so stdin stays free for them.
+func (sr *ShellScript) writeFunction(w io.Writer, name, user string, cmds []ci.Command) {
+	fmt.Fprintf(w, "%s() {\n", name)
+
+	body, script := w, new(bytes.Buffer)
+	onError := "return"
+	if len(user) > 0 {
+		body = script
+		onError = "exit"
+	}
+
+	if len(cmds) == 0 {
+		io.WriteString(body, ":\n")
+	}
+	for _, cmd := range cmds {
+		sr.Strategy(sr, body, cmd, onError)
+	}
+
+	if len(user) > 0 {
+		file := guestStateDirectory + "/" + name + ".sh"
+		fmt.Fprintf(w, "mkdir -p '%s' && printf '%%s' %s > '%s' && chmod 0644 '%s' || return $?\n",
+			guestStateDirectory, shellQuote(script.String()), file, file)
+		fmt.Fprintf(w, "localcb_run_as '%s' '%s'\n", user, file)
+	}
+	io.WriteString(w, "}\n")
+}
+
+// writeRunAs declares a shell function which runs commands from the given
+// file as the given user. The environment is preserved (except HOME, which
+// follows the user), but since the commands are run in a separate shell,
+// variables set by them are not visible outside of their stage.
+func (sr *ShellScript) writeRunAs(w io.Writer) {
+	io.WriteString(w, "localcb_run_as() {\n")
+	io.WriteString(w, "id \"$1\" >/dev/null 2>&1 || { echo \"[Container] User $1 (run-as) does not exist\" >&2; return 1; }\n")
+	io.WriteString(w, "HOME=\"$(eval echo \"~$1\")\" su -p -s \"$(command -v "+sr.Shell+")\" \"$1\" -c \". '$2'\"\n")
+	io.WriteString(w, "}\n")
+	sr.runAsDeclared = true
+}
+
+// writeHome sets HOME to the home directory of the user, which is looked up
+// in the container
+func writeHome(w io.Writer, user string) {
+	fmt.Fprintf(w, "HOME=\"$(eval echo \"~\"%s)\"\n", shellQuote(user))
+	io.WriteString(w, "export HOME\n")
+}
+
+// writeStatus reports result of the stage and, if it failed, marks the whole
+// build as failing and decides which stages are still going to be run.
+func (sr *ShellScript) writeStatus(w io.Writer, s *ci.Stage) {
+	phase := strings.ToUpper(s.Name)
+
+	io.WriteString(w, "if [ $localcb_status -eq 0 ]; then\n")
+	fmt.Fprintf(w, "echo '[Container] Phase complete: %s State: SUCCEEDED'\n", phase)
+	io.WriteString(w, "else\n")
+	fmt.Fprintf(w, "echo '[Container] Phase complete: %s State: FAILED'\n", phase)
+	io.WriteString(w, "localcb_failed=1\n")
+	io.WriteString(w, "CODEBUILD_BUILD_SUCCEEDING=0\n")
+	io.WriteString(w, "export CODEBUILD_BUILD_SUCCEEDING\n")
+	if s.OnFailure == ci.Abort {
+		skipTo := s.Fallback
+		if skipTo == "" {
+			skipTo = "-"
+		}
+		fmt.Fprintf(w, "localcb_skip_to='%s'\n", skipTo)
+	}
+	io.WriteString(w, "fi\n")
+}
+
 func (sr *ShellScript) enterStage(w io.Writer, s *ci.Stage) {
 	io.WriteString(w, "# ********************************\n")
 	fmt.Fprintf(w, "# > Entering '%s' stage\n", s.Name)
 	fmt.Fprintf(w, "# * Found %d command(s)\n", len(s.Commands))
-	if len(s.Commands) > 0 {
-		io.WriteString(w, "# ---\n")
+	if len(s.Finally) > 0 {
+		fmt.Fprintf(w, "# * Found %d finally command(s)\n", len(s.Finally))
 	}
+	io.WriteString(w, "# ---\n")
 }
 
 func (sr *ShellScript) exitStage(w io.Writer, s *ci.Stage) {
-	if len(s.Commands) > 0 {
-		io.WriteString(w, "# ---\n")
-	}
+	io.WriteString(w, "# ---\n")
 	fmt.Fprintf(w, "# < Exiting '%s' stage\n", s.Name)
 	io.WriteString(w, "# ********************************\n")
 	io.WriteString(w, "\n")
@@ -0,0 +1,73 @@
+package codebuild
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/piotrkubisa/localcb/ci"
+)
+
+// TestSharedShellState runs the script under sh and bash, the state of the
+// shell set in one stage has to be visible in the following ones.
+func TestSharedShellState(t *testing.T) {
+	stages := []*ci.Stage{
+		{Name: "install", Commands: []ci.Command{
+			{Exec: "FOO='two words'"},
+			{Exec: "mkdir -p sub && cd sub"},
+		}},
+		{Name: "build", Fallback: "post_build", Commands: []ci.Command{
+			{Exec: `[ "$FOO" = 'two words' ]`},
+			{Exec: `[ "${PWD##*/}" = sub ]`},
+			{Exec: "exit 3"},
+		}, Finally: []ci.Command{
+			{Exec: `[ "$FOO" = 'two words' ]`},
+		}},
+		{Name: "post_build", Commands: []ci.Command{
+			{Exec: `[ "$FOO" = 'two words' ] && [ "${PWD##*/}" = sub ]`},
+		}},
+	}
+
+	sr := NewShellScript(SharedShell)
+	sr.Begin()
+	for _, stage := range stages {
+		if err := sr.ExtractStage(stage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	io.WriteString(sr.Buffer, "exit $localcb_failed\n")
+
+	for _, shell := range []string{"sh", "bash"} {
+		if _, err := exec.LookPath(shell); err != nil {
+			t.Logf("%s is not available: %s", shell, err)
+			continue
+		}
+
+		dir, err := ioutil.TempDir("", "localcb-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		cmd := exec.Command(shell, "-c", sr.Buffer.String())
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "TMPDIR="+dir)
+		out, err := cmd.CombinedOutput()
+		if code := cmd.ProcessState.ExitCode(); code != 1 {
+			t.Errorf("%s: expected exit code 1, got %d (%v)\n%s", shell, code, err, out)
+		}
+
+		for _, line := range []string{
+			"[Container] Phase complete: INSTALL State: SUCCEEDED",
+			"[Container] Phase complete: BUILD State: FAILED",
+			"[Container] Phase complete: POST_BUILD State: SUCCEEDED",
+		} {
+			if !strings.Contains(string(out), line) {
+				t.Errorf("%s: missing %q in the output\n%s", shell, line, out)
+			}
+		}
+	}
+}
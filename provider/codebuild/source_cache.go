@@ -0,0 +1,102 @@
+package codebuild
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CheckoutSource replaces the source directory with a git checkout of its
+// current commit, kept in the source cache. The clone is reused between the
+// builds, so only new objects are fetched and the build always starts from a
+// clean working tree. Uncommitted changes are not a part of the checkout.
+func (cb *CodeBuild) CheckoutSource(lc LocalCache) error {
+	src, err := filepath.Abs(cb.Project.Source.Location)
+	if err != nil {
+		return err
+	}
+
+	repo, err := git(src, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return fmt.Errorf("source cache requires a git repository: %s", err)
+	}
+	prefix, err := git(src, "rev-parse", "--show-prefix")
+	if err != nil {
+		return err
+	}
+	commit, err := git(src, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if status, err := git(src, "status", "--porcelain"); err == nil && len(status) > 0 {
+		log.Printf("Uncommitted changes in %s are not a part of the source cache checkout", repo)
+	}
+
+	checkout := lc.Location()
+	if _, err := os.Stat(filepath.Join(checkout, ".git")); os.IsNotExist(err) {
+		log.Printf("Creating source cache of %s in %s", repo, checkout)
+		if err := os.MkdirAll(checkout, 0755); err != nil {
+			return err
+		}
+		if _, err := git(checkout, "init", "--quiet"); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Checking out %s from the source cache", commit)
+	steps := [][]string{
+		{"fetch", "--quiet", "--no-tags", repo, "HEAD"},
+		{"checkout", "--quiet", "--force", "--detach", commit},
+		{"clean", "--quiet", "-ffdx"},
+	}
+	for _, args := range steps {
+		if _, err := git(checkout, args...); err != nil {
+			return err
+		}
+	}
+
+	cb.Project.Source.Location = filepath.Join(checkout, prefix)
+	cb.SourceVersion = commit
+	return nil
+}
+
+// ResolveSourceVersion sets the SourceVersion to the current commit of the
+// source directory, unless it is already known. The version stays empty when
+// the source directory is not a git repository.
+func (cb *CodeBuild) ResolveSourceVersion() {
+	if len(cb.SourceVersion) > 0 {
+		return
+	}
+
+	src, err := filepath.Abs(cb.Project.Source.Location)
+	if err != nil {
+		return
+	}
+	commit, err := git(src, "rev-parse", "HEAD")
+	if err != nil {
+		return
+	}
+	if status, err := git(src, "status", "--porcelain"); err == nil && len(status) > 0 {
+		log.Printf("Uncommitted changes in %s are not a part of the source version %s", src, commit)
+	}
+	cb.SourceVersion = commit
+}
+
+// git runs the git command in the directory and returns its trimmed output
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,113 @@
+package codebuild
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// RunSummary describes result of the build, which is printed out when the
+// container stops.
+type RunSummary struct {
+	ExitCode          int64
+	ExportedVariables ExportedVariables
+	Artifacts         []CollectedArtifact
+	Reports           []Report
+	// Commands are results of the commands run in the exec mode
+	Commands []CommandResult
+}
+
+// Print writes the summary in a human-readable form
+func (s RunSummary) Print(w io.Writer) {
+	status := "SUCCEEDED"
+	if s.ExitCode != 0 {
+		status = "FAILED"
+	}
+
+	fmt.Fprintf(w, "[Container] Build summary\n")
+	fmt.Fprintf(w, "  Status: %s (exit code %d)\n", status, s.ExitCode)
+	if len(s.Commands) > 0 {
+		fmt.Fprintf(w, "  Commands:\n")
+		for _, c := range s.Commands {
+			fmt.Fprintf(w, "    %s: %s (exit code %d, %s)\n", c.Phase, firstLine(c.Command), c.ExitCode, formatDuration(int64(c.Duration())))
+		}
+	}
+	for _, a := range s.Artifacts {
+		if len(a.Identifier) > 0 {
+			fmt.Fprintf(w, "  Artifact (%s): %s\n", a.Identifier, a.Location)
+		} else {
+			fmt.Fprintf(w, "  Artifact: %s\n", a.Location)
+		}
+		fmt.Fprintf(w, "    Manifest: %s\n", a.Manifest)
+	}
+	for _, r := range s.Reports {
+		r.Print(w)
+	}
+
+	if len(s.ExportedVariables) > 0 {
+		fmt.Fprintf(w, "  Exported variables:\n")
+		for _, name := range s.ExportedVariables.Names() {
+			if value := s.ExportedVariables[name]; value != nil {
+				fmt.Fprintf(w, "    %s=%s\n", name, *value)
+			} else {
+				fmt.Fprintf(w, "    %s (not set)\n", name)
+			}
+		}
+	}
+}
+
+// Err returns an error when the build has failed or has not met the code
+// coverage thresholds
+func (s RunSummary) Err() error {
+	if s.ExitCode != 0 {
+		return fmt.Errorf("localcb: build failed, container exited with code %d", s.ExitCode)
+	}
+
+	if violations := CoverageViolations(s.Reports); len(violations) > 0 {
+		return fmt.Errorf("localcb: build failed, code coverage thresholds not met in %s", strings.Join(violations, ", "))
+	}
+
+	return nil
+}
+
+// ExportedVariables maps names of the `exported-variables` to their values.
+// The value is nil when the variable was not set at the end of the build.
+type ExportedVariables map[string]*string
+
+// ParseExportedVariables reads NUL-separated key=value entries written by the
+// localcb.sh script. Variables which are listed in names, but were not
+// written, are considered as not set.
+func ParseExportedVariables(names []string, contents []byte) ExportedVariables {
+	ev := ExportedVariables{}
+	for _, name := range names {
+		ev[name] = nil
+	}
+
+	for _, entry := range bytes.Split(contents, []byte{0}) {
+		kv := bytes.SplitN(entry, []byte("="), 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := string(kv[1])
+		ev[string(kv[0])] = &value
+	}
+
+	return ev
+}
+
+// Names returns sorted names of the variables
+func (ev ExportedVariables) Names() []string {
+	names := []string{}
+	for name := range ev {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save writes the variables to a JSON file, unset ones are saved as nulls.
+func (ev ExportedVariables) Save(location string) error {
+	return saveJSON(location, ev)
+}
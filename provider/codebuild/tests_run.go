@@ -0,0 +1,108 @@
+package codebuild
+
+import (
+	"path"
+	"strings"
+)
+
+// guestBinDirectory holds helper commands of the AWS CodeBuild, which are
+// copied into the container and added to the PATH by the localcb.sh script
+const guestBinDirectory = guestStateDirectory + "/bin"
+
+// testsRunScript mimics codebuild-tests-run, which runs the test command with
+// test files of the current shard of the build fanout. Files are appended to
+// the test command, unless it refers to $CODEBUILD_CURRENT_SHARD_FILES.
+const testsRunScript = `#!/bin/sh
+# codebuild-tests-run, as emulated by localcb
+usage() {
+	echo "usage: codebuild-tests-run --test-command <command> --files-search <command> [--sharding-strategy equal-distribution|stability]" >&2
+	exit 2
+}
+
+test_command=''
+files_search=''
+strategy='equal-distribution'
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--test-command=*) test_command="${1#*=}"; shift ;;
+	--files-search=*) files_search="${1#*=}"; shift ;;
+	--sharding-strategy=*) strategy="${1#*=}"; shift ;;
+	--test-command|--files-search|--sharding-strategy)
+		[ $# -ge 2 ] || usage
+		case "$1" in
+		--test-command) test_command="$2" ;;
+		--files-search) files_search="$2" ;;
+		*) strategy="$2" ;;
+		esac
+		shift 2 ;;
+	*) echo "codebuild-tests-run: unknown option $1" >&2; usage ;;
+	esac
+done
+[ -n "$test_command" ] && [ -n "$files_search" ] || usage
+
+shard="${CODEBUILD_CURRENT_SHARD_NUMBER:-1}"
+total="${CODEBUILD_TOTAL_SHARDS:-1}"
+
+all_files="$(eval "$files_search")" || { echo "codebuild-tests-run: files search failed" >&2; exit 1; }
+all_files="$(printf '%s\n' "$all_files" | sed '/^$/d' | LC_ALL=C sort -u)"
+
+case "$strategy" in
+equal-distribution)
+	shard_files="$(printf '%s\n' "$all_files" | sed '/^$/d' | awk -v shard="$shard" -v total="$total" '
+		{ files[NR] = $0 }
+		END { for (i = 1; i <= NR; i++) if (int((i - 1) * total / NR) + 1 == shard) print files[i] }')"
+	;;
+stability)
+	shard_files="$(printf '%s\n' "$all_files" | sed '/^$/d' | while IFS= read -r f; do
+		sum=$(printf '%s' "$f" | cksum | cut -d ' ' -f 1)
+		if [ $((sum % total + 1)) -eq "$shard" ]; then printf '%s\n' "$f"; fi
+	done)"
+	;;
+*)
+	echo "codebuild-tests-run: unknown sharding strategy $strategy, expected equal-distribution or stability" >&2
+	exit 2 ;;
+esac
+
+count_files() { printf '%s\n' "$1" | sed '/^$/d' | wc -l | tr -d ' '; }
+echo "[Container] Shard $shard of $total: $(count_files "$shard_files") of $(count_files "$all_files") test file(s), $strategy strategy"
+
+export CODEBUILD_CURRENT_SHARD_FILES="$shard_files"
+if [ -z "$shard_files" ]; then
+	echo "[Container] No test files in this shard, skipping the test command"
+	exit 0
+fi
+
+case "$test_command" in
+*CODEBUILD_CURRENT_SHARD_FILES*)
+	eval "$test_command" ;;
+*)
+	args="$(printf '%s\n' "$shard_files" | sed "s/'/'\\\\''/g; s/^/'/; s/\$/'/" | tr '\n' ' ')"
+	eval "$test_command $args" ;;
+esac
+`
+
+// globSearchScript mimics codebuild-glob-search, which lists files matching
+// the glob patterns. Patterns are matched by find -path, so * matches also /.
+const globSearchScript = `#!/bin/sh
+# codebuild-glob-search, as emulated by localcb
+[ $# -gt 0 ] || { echo "usage: codebuild-glob-search <pattern>..." >&2; exit 2; }
+for pattern in "$@"; do
+	pattern="${pattern#./}"
+	case "$pattern" in
+	'**/'*)
+		rest="${pattern#'**/'}"
+		find . -type f \( -path "./$rest" -o -path "./*/$rest" \) ;;
+	*)
+		find . -type f -path "./$pattern" ;;
+	esac
+done | sed 's|^\./||' | LC_ALL=C sort -u
+`
+
+// helperFiles returns helper commands, with paths relative to /
+func helperFiles() map[string][]byte {
+	dir := strings.TrimPrefix(guestBinDirectory, "/")
+	return map[string][]byte{
+		path.Join(dir, "codebuild-tests-run"):   []byte(testsRunScript),
+		path.Join(dir, "codebuild-glob-search"): []byte(globSearchScript),
+	}
+}
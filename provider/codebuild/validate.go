@@ -0,0 +1,454 @@
+package codebuild
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Severity levels of the Diagnostic
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic describes a single problem found in the `buildspec.yml` file
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+}
+
+// rule describes expected shape of a node in the `buildspec.yml` file
+type rule struct {
+	kind yaml.Kind
+
+	// keys lists known keys of a mapping; values is a rule for values of a
+	// mapping with arbitrary keys or for items of a sequence
+	keys   map[string]*rule
+	values *rule
+
+	// strings requires scalar to be a string, enum lists allowed values
+	strings bool
+	enum    []string
+
+	// unsupported explains why the key is accepted by the AWS CodeBuild,
+	// but ignored by the localcb
+	unsupported string
+}
+
+func mapping(keys map[string]*rule) *rule { return &rule{kind: yaml.MappingNode, keys: keys} }
+func dict(values *rule) *rule             { return &rule{kind: yaml.MappingNode, values: values} }
+func list(items *rule) *rule              { return &rule{kind: yaml.SequenceNode, values: items} }
+func scalar() *rule                       { return &rule{kind: yaml.ScalarNode} }
+func str() *rule                          { return &rule{kind: yaml.ScalarNode, strings: true} }
+func enum(v ...string) *rule              { return &rule{kind: yaml.ScalarNode, enum: v} }
+func unsupported(reason string) *rule     { return &rule{unsupported: reason} }
+
+func phaseRule(install bool) *rule {
+	r := mapping(map[string]*rule{
+		"run-as":     str(),
+		"on-failure": enum("ABORT", "CONTINUE"),
+		"commands":   list(scalar()),
+		"finally":    list(scalar()),
+	})
+	if install {
+		r.keys["runtime-versions"] = dict(scalar())
+	}
+	return r
+}
+
+func artifactsRule(primary bool) *rule {
+	r := mapping(map[string]*rule{
+		"files":           list(str()),
+		"name":            str(),
+		"discard-paths":   enum("yes", "no"),
+		"base-directory":  str(),
+		"exclude-paths":   list(str()),
+		"enable-symlinks": enum("yes", "no"),
+		"s3-prefix":       unsupported("artifacts are not uploaded to S3 by localcb"),
+	})
+	if primary {
+		r.keys["secondary-artifacts"] = dict(artifactsRule(false))
+	}
+	return r
+}
+
+func batchEnvRule() *rule {
+	return mapping(map[string]*rule{
+		"image":           str(),
+		"compute-type":    str(),
+		"type":            str(),
+		"privileged-mode": enum("true", "false"),
+		"variables":       dict(str()),
+	})
+}
+
+func batchBuildRule(graph bool) *rule {
+	r := mapping(map[string]*rule{
+		"identifier":     str(),
+		"env":            batchEnvRule(),
+		"buildspec":      str(),
+		"ignore-failure": enum("true", "false"),
+		"debug-session":  unsupported("Session Manager is not available in local builds"),
+	})
+	if graph {
+		r.keys["depend-on"] = list(str())
+	}
+	return r
+}
+
+// buildSpecRule describes all keys of the `buildspec.yml` file known by the
+// localcb, see: https://docs.aws.amazon.com/codebuild/latest/userguide/build-spec-ref.html
+var buildSpecRule = mapping(map[string]*rule{
+	"version": enum("0.1", "0.2"),
+	"run-as":  str(),
+	"env": mapping(map[string]*rule{
+		"shell":                 str(),
+		"variables":             dict(str()),
+		"parameter-store":       dict(str()),
+		"secrets-manager":       dict(str()),
+		"exported-variables":    list(str()),
+		"git-credential-helper": unsupported("git credentials are not managed by localcb"),
+	}),
+	"proxy": unsupported("proxy server is not emulated by localcb"),
+	"phases": mapping(map[string]*rule{
+		"install":    phaseRule(true),
+		"pre_build":  phaseRule(false),
+		"build":      phaseRule(false),
+		"post_build": phaseRule(false),
+	}),
+	"reports": dict(mapping(map[string]*rule{
+		"files":          list(str()),
+		"base-directory": str(),
+		"discard-paths":  enum("yes", "no"),
+		"file-format": enum(
+			FormatJUnit, FormatCucumber, FormatTestNG, FormatNUnit, FormatNUnit3,
+			FormatClover, FormatCobertura, FormatJaCoCo, FormatSimpleCov,
+		),
+	})),
+	"artifacts": artifactsRule(true),
+	"cache": mapping(map[string]*rule{
+		"paths":         list(str()),
+		"key":           unsupported("S3 cache is not used by localcb"),
+		"fallback-keys": unsupported("S3 cache is not used by localcb"),
+		"action":        unsupported("S3 cache is not used by localcb"),
+	}),
+	"batch": mapping(map[string]*rule{
+		"fast-fail":  enum("true", "false"),
+		"build-list": list(batchBuildRule(false)),
+		"build-matrix": mapping(map[string]*rule{
+			"static": mapping(map[string]*rule{
+				"ignore-failure": enum("true", "false"),
+				"env":            batchEnvRule(),
+				"debug-session":  unsupported("Session Manager is not available in local builds"),
+			}),
+			"dynamic": mapping(map[string]*rule{
+				"buildspec": list(str()),
+				"env": mapping(map[string]*rule{
+					"image":        list(str()),
+					"compute-type": list(str()),
+					"variables":    dict(list(str())),
+				}),
+			}),
+		}),
+		"build-graph": list(batchBuildRule(true)),
+		"build-fanout": mapping(map[string]*rule{
+			"parallelism":    scalar(),
+			"ignore-failure": enum("true", "false"),
+		}),
+	}),
+})
+
+// ValidateBuildSpec checks the `buildspec.yml` file and reports unknown keys,
+// values of wrong types, empty phases and features unsupported by localcb.
+// The error is returned only if the file cannot be read.
+func ValidateBuildSpec(filePath string) ([]Diagnostic, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validator{file: filePath}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		v.syntaxError(err)
+		return v.diagnostics, nil
+	}
+	if len(doc.Content) == 0 {
+		v.report(&doc, SeverityError, "", "buildspec is empty")
+		return v.diagnostics, nil
+	}
+
+	root := doc.Content[0]
+	v.check(root, buildSpecRule, "")
+	if root.Kind == yaml.MappingNode {
+		v.checkRequired(root)
+	}
+
+	sort.SliceStable(v.diagnostics, func(i, j int) bool {
+		a, b := v.diagnostics[i], v.diagnostics[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return v.diagnostics, nil
+}
+
+type validator struct {
+	file        string
+	diagnostics []Diagnostic
+}
+
+func (v *validator) report(n *yaml.Node, severity, path, format string, args ...interface{}) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		File:     v.file,
+		Line:     n.Line,
+		Column:   n.Column,
+		Severity: severity,
+		Path:     path,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// syntaxError turns an error of the YAML parser into a diagnostic
+func (v *validator) syntaxError(err error) {
+	line, msg := 1, strings.TrimPrefix(err.Error(), "yaml: ")
+	if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+		line, _ = strconv.Atoi(m[1])
+		msg = strings.TrimPrefix(err.Error(), m[0])
+	}
+
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		File:     v.file,
+		Line:     line,
+		Column:   1,
+		Severity: SeverityError,
+		Message:  msg,
+	})
+}
+
+func (v *validator) check(n *yaml.Node, r *rule, path string) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if r.unsupported != "" {
+		v.report(n, SeverityWarning, path, "%s is ignored: %s", path, r.unsupported)
+		return
+	}
+	if n.Tag == "!!null" {
+		return
+	}
+	if n.Kind != r.kind {
+		v.report(n, SeverityError, path, "%s must be %s, got %s", path, kindName(r.kind), nodeType(n))
+		return
+	}
+
+	switch n.Kind {
+	case yaml.ScalarNode:
+		v.checkScalar(n, r, path)
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			v.check(item, r.values, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case yaml.MappingNode:
+		v.checkMapping(n, r, path)
+	}
+}
+
+func (v *validator) checkScalar(n *yaml.Node, r *rule, path string) {
+	if r.strings && n.Tag != "!!str" {
+		v.report(n, SeverityError, path, "%s must be a string, got %s (quote the value)", path, nodeType(n))
+		return
+	}
+	if len(r.enum) == 0 {
+		return
+	}
+	for _, e := range r.enum {
+		if n.Value == e {
+			return
+		}
+	}
+	v.report(n, SeverityError, path, "%s has unsupported value %q, expected one of: %s", path, n.Value, strings.Join(r.enum, ", "))
+}
+
+func (v *validator) checkMapping(n *yaml.Node, r *rule, parent string) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		path := key.Value
+		if parent != "" {
+			path = parent + "." + key.Value
+		}
+
+		if r.keys == nil {
+			v.check(value, r.values, path)
+			continue
+		}
+
+		known, ok := r.keys[key.Value]
+		if !ok {
+			msg := fmt.Sprintf("unknown key %q", key.Value)
+			if parent != "" {
+				msg += " in " + parent
+			}
+			if s := suggestKey(key.Value, r.keys); s != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", s)
+			}
+			v.report(key, SeverityError, path, "%s", msg)
+			continue
+		}
+		if known.unsupported != "" {
+			v.report(key, SeverityWarning, path, "%s is ignored: %s", path, known.unsupported)
+			continue
+		}
+		v.check(value, known, path)
+	}
+}
+
+// checkRequired reports missing version, missing phases and phases which
+// do not have any command to run.
+func (v *validator) checkRequired(root *yaml.Node) {
+	if lookup(root, "version") == nil {
+		v.report(root, SeverityError, "version", "missing version, expected 0.1 or 0.2")
+	}
+
+	phasesKey, phases := lookupKey(root, "phases")
+	if phases == nil {
+		v.report(root, SeverityError, "phases", "missing phases")
+		return
+	}
+	if phases.Kind != yaml.MappingNode || len(phases.Content) == 0 {
+		v.report(phasesKey, SeverityError, "phases", "phases must define at least one phase")
+		return
+	}
+
+	for i := 0; i+1 < len(phases.Content); i += 2 {
+		key, phase := phases.Content[i], phases.Content[i+1]
+		if phase.Kind != yaml.MappingNode && phase.Tag != "!!null" {
+			continue
+		}
+		commands := lookup(phase, "commands")
+		if commands != nil && commands.Kind != yaml.SequenceNode && commands.Tag != "!!null" {
+			// Wrong type of the commands has been already reported
+			continue
+		}
+		if hasItems(commands) || hasItems(lookup(phase, "runtime-versions")) {
+			continue
+		}
+		v.report(key, SeverityError, "phases."+key.Value, "phase %s has no commands", key.Value)
+	}
+}
+
+// lookupKey returns the key and the value nodes of the mapping entry
+func lookupKey(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+func lookup(n *yaml.Node, key string) *yaml.Node {
+	_, value := lookupKey(n, key)
+	return value
+}
+
+func hasItems(n *yaml.Node) bool {
+	return n != nil && (n.Kind == yaml.SequenceNode || n.Kind == yaml.MappingNode) && len(n.Content) > 0
+}
+
+// suggestKey looks for a known key which is most likely meant by the user,
+// i.e. pre-build instead of pre_build.
+func suggestKey(key string, known map[string]*rule) string {
+	normalize := func(s string) string {
+		return strings.Replace(strings.ToLower(s), "_", "-", -1)
+	}
+
+	best, bestDistance := "", 3
+	for k := range known {
+		if normalize(k) == normalize(key) {
+			return k
+		}
+		if d := levenshtein(key, k); d < bestDistance || (d == bestDistance && k < best) {
+			best, bestDistance = k, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func kindName(k yaml.Kind) string {
+	switch k {
+	case yaml.MappingNode:
+		return "a map"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	return "a scalar value"
+}
+
+// nodeType describes type of the node in the diagnostic messages
+func nodeType(n *yaml.Node) string {
+	if n.Kind != yaml.ScalarNode {
+		return kindName(n.Kind)
+	}
+
+	switch n.Tag {
+	case "!!int", "!!float":
+		return "a number"
+	case "!!bool":
+		return "a boolean"
+	case "!!str":
+		return "a string"
+	}
+	return "a scalar value"
+}